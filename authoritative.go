@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// authZones caches the zone cuts found for -authoritative: the IPv4
+// nameserver addresses of each zone, or nil for names that turned out not
+// to be zones. addrs holds every nameserver address handed out.
+var authZones = struct {
+	sync.Mutex
+	zones map[string][]string
+	addrs map[string]bool
+}{
+	zones: make(map[string][]string),
+	addrs: make(map[string]bool),
+}
+
+// authoritativeServer returns the address of one of the nameservers for the
+// zone domain lives in, discovering the zone through server (a recursive
+// resolver).
+func authoritativeServer(ctx context.Context, domain, server string) (string, error) {
+	labels := dns.SplitDomainName(domain)
+	for i := range labels {
+		zone := dns.Fqdn(strings.Join(labels[i:], "."))
+
+		authZones.Lock()
+		addrs, known := authZones.zones[zone]
+		authZones.Unlock()
+
+		if !known {
+			ns, err := nsAt(ctx, zone, server)
+			if err != nil {
+				return "", err
+			}
+			if len(ns) > 0 {
+				addrs = nameserverAddrs(ctx, ns)
+				if len(addrs) == 0 {
+					return "", fmt.Errorf("no addresses for the nameservers of %s", strings.TrimSuffix(zone, "."))
+				}
+			}
+
+			authZones.Lock()
+			authZones.zones[zone] = addrs
+			for _, a := range addrs {
+				authZones.addrs[a] = true
+			}
+			authZones.Unlock()
+		}
+
+		if len(addrs) > 0 {
+			return addrs[rand.Intn(len(addrs))], nil
+		}
+	}
+	return "", fmt.Errorf("no zone found for %s", domain)
+}
+
+// isAuthoritativeServer reports whether server was handed out by
+// authoritativeServer, and so shouldn't be asked to recurse.
+func isAuthoritativeServer(server string) bool {
+	authZones.Lock()
+	defer authZones.Unlock()
+	return authZones.addrs[server]
+}
+
+// nameserverAddrs resolves the IPv4 addresses of the nameserver hosts ns.
+func nameserverAddrs(ctx context.Context, ns []string) []string {
+	var addrs []string
+	for _, host := range ns {
+		ips, err := systemResolver.LookupIP(ctx, "ip", strings.TrimSuffix(host, "."))
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ip4 := ip.To4(); ip4 != nil {
+				addrs = append(addrs, ip4.String())
+			}
+		}
+	}
+	return addrs
+}
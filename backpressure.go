@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// droppableStatuses are the statuses -drop-when-full may name. Takeovers
+// are never dropped.
+var droppableStatuses = []string{
+	statusOK,
+	statusService,
+	statusDangling,
+	statusDanglingPartial,
+	statusNeedsConfirmation,
+	statusTransportMismatch,
+	statusSuspiciousLength,
+	statusDelegationBroken,
+	statusCloaking,
+	statusHomoglyph,
+	statusMalformedCNAMEIP,
+	statusWildcard,
+	statusLookupError,
+}
+
+// parseDropStatuses parses a comma-separated list of statuses that may be
+// dropped when the printer can't keep up.
+func parseDropStatuses(list string) (map[string]bool, error) {
+	drop := make(map[string]bool)
+	for _, s := range strings.Split(list, ",") {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if s == "" {
+			continue
+		}
+		if s == statusTakeover {
+			return nil, fmt.Errorf("takeover results can't be dropped")
+		}
+		if !slices.Contains(droppableStatuses, s) {
+			return nil, fmt.Errorf("unknown status %q", s)
+		}
+		drop[s] = true
+	}
+	return drop, nil
+}
+
+// sendResult sends r on out. If out is full and r's status is one of
+// config.dropStatuses, r is counted as dropped instead of waiting for the
+// printer to catch up.
+func sendResult(out chan<- Result, r Result) {
+	if !config.dropStatuses[r.Status] {
+		out <- r
+		return
+	}
+
+	select {
+	case out <- r:
+	default:
+		stats.dropped.Add(1)
+	}
+}
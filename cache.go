@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultCacheTTL is used for responses without any records to take a
+	// TTL from.
+	defaultCacheTTL = time.Minute
+	// resolvesCacheTTL is how long a resolution check is remembered; the
+	// system resolver doesn't tell us the TTLs involved.
+	resolvesCacheTTL = 5 * time.Minute
+)
+
+// cache stores values for a limited time. Implementations must be safe for
+// concurrent use.
+type cache interface {
+	get(key string) ([]byte, bool)
+	set(key string, value []byte, ttl time.Duration)
+}
+
+// responseCache is where responses and resolution checks are cached; nil
+// means nothing is.
+var responseCache cache
+
+type bypassCacheKey struct{}
+
+// bypassCache returns a context whose queries are always sent to the
+// resolver asked, for checks that are about what that resolver in
+// particular says.
+func bypassCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bypassCacheKey{}, true)
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// memoryCache is a cache local to the process. Expired entries are removed
+// when they're read, and the rest of them at most every
+// memorySweepInterval when something new is stored, so that names looked up
+// only once don't stay around for the whole run.
+type memoryCache struct {
+	mu        sync.Mutex
+	entries   map[string]memoryEntry
+	nextSweep time.Time
+}
+
+const memorySweepInterval = time.Minute
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{entries: make(map[string]memoryEntry)}
+}
+
+func (c *memoryCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (c *memoryCache) set(key string, value []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.After(c.nextSweep) {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.nextSweep = now.Add(memorySweepInterval)
+	}
+	c.entries[key] = memoryEntry{value: value, expires: now.Add(ttl)}
+}
+
+// cachingExchanger answers queries from responseCache where it can, keyed
+// by name and type regardless of the resolver asked. Queries carrying an
+// EDNS client subnet are always sent, since their answers are specific to
+// that subnet, as are those made with bypassCache, like the ones for -nsid
+// and -spoof-check, which are about the resolver asked. So are queries without
+// recursion desired, the ones to authoritative nameservers and with
+// -no-recursion, since they're about what that server itself holds rather
+// than what any resolver would answer.
+type cachingExchanger struct {
+	exchanger
+}
+
+func (c cachingExchanger) Exchange(ctx context.Context, m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	if len(m.Question) == 0 || !m.RecursionDesired || hasClientSubnet(m) || ctx.Value(bypassCacheKey{}) != nil {
+		return c.exchanger.Exchange(ctx, m, address)
+	}
+
+	q := m.Question[0]
+	key := "msg " + replayKey(q.Name, dns.TypeToString[q.Qtype])
+	if packed, ok := responseCache.get(key); ok {
+		r := new(dns.Msg)
+		if err := r.Unpack(packed); err == nil {
+			r.Id = m.Id
+			stats.cacheHits.Add(1)
+			return r, 0, nil
+		}
+	}
+	stats.cacheMisses.Add(1)
+
+	r, rtt, err := c.exchanger.Exchange(ctx, m, address)
+	if err != nil || r.Truncated {
+		return r, rtt, err
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return r, rtt, err
+	}
+	// a TTL of 0 means the answer isn't to be reused at all, and shared
+	// caches would take it to mean it never expires
+	ttl := responseTTL(r)
+	if ttl <= 0 {
+		return r, rtt, nil
+	}
+	if packed, err := r.Pack(); err == nil {
+		responseCache.set(key, packed, ttl)
+	}
+	return r, rtt, nil
+}
+
+func hasClientSubnet(m *dns.Msg) bool {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0SUBNET {
+			return true
+		}
+	}
+	return false
+}
+
+// responseTTL is the lowest TTL of the records in r.
+func responseTTL(r *dns.Msg) time.Duration {
+	var min uint32
+	found := false
+	for _, rrs := range [][]dns.RR{r.Answer, r.Ns} {
+		for _, rr := range rrs {
+			if ttl := rr.Header().Ttl; !found || ttl < min {
+				min = ttl
+				found = true
+			}
+		}
+	}
+	if !found {
+		return defaultCacheTTL
+	}
+	return time.Duration(min) * time.Second
+}
+
+// fallbackCache uses the primary cache, usually a shared one, but switches
+// to a local cache for good the first time the primary fails.
+type fallbackCache struct {
+	mu      sync.Mutex
+	primary failableCache
+	failed  bool
+	local   *memoryCache
+}
+
+// failableCache is a cache whose operations can fail, like one over the
+// network.
+type failableCache interface {
+	tryGet(key string) ([]byte, bool, error)
+	trySet(key string, value []byte, ttl time.Duration) error
+}
+
+func newFallbackCache(primary failableCache) *fallbackCache {
+	return &fallbackCache{primary: primary, local: newMemoryCache()}
+}
+
+func (c *fallbackCache) usePrimary() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.failed
+}
+
+func (c *fallbackCache) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.failed {
+		c.failed = true
+		warnCacheFallback(err)
+	}
+}
+
+func (c *fallbackCache) get(key string) ([]byte, bool) {
+	if c.usePrimary() {
+		v, ok, err := c.primary.tryGet(key)
+		if err == nil {
+			return v, ok
+		}
+		c.fail(err)
+	}
+	return c.local.get(key)
+}
+
+func (c *fallbackCache) set(key string, value []byte, ttl time.Duration) {
+	if c.usePrimary() {
+		err := c.primary.trySet(key, value, ttl)
+		if err == nil {
+			return
+		}
+		c.fail(err)
+	}
+	c.local.set(key, value, ttl)
+}
@@ -0,0 +1,11 @@
+//go:build !redis
+
+package main
+
+import "errors"
+
+func newSharedCache(string) (cache, error) {
+	return nil, errors.New("built without redis support; rebuild with -tags redis")
+}
+
+func warnCacheFallback(error) {}
@@ -0,0 +1,58 @@
+//go:build redis
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const redisTimeout = 2 * time.Second
+
+// redisCache shares cached responses between every instance of the tool
+// pointed at the same Redis server.
+type redisCache struct {
+	client *redis.Client
+}
+
+func (c redisCache) tryGet(key string) ([]byte, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	v, err := c.client.Get(ctx, "check-cnames:"+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return v, true, nil
+}
+
+func (c redisCache) trySet(key string, value []byte, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	return c.client.Set(ctx, "check-cnames:"+key, value, ttl).Err()
+}
+
+// newSharedCache connects to the Redis server at addr. If it can't be
+// reached the run carries on with a local cache.
+func newSharedCache(addr string) (cache, error) {
+	rc := redisCache{redis.NewClient(&redis.Options{Addr: addr})}
+	c := newFallbackCache(rc)
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := rc.client.Ping(ctx).Err(); err != nil {
+		c.fail(err)
+	}
+	return c, nil
+}
+
+func warnCacheFallback(err error) {
+	slog.Warn("redis unavailable, using a local cache instead", "err", err)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// countingExchanger answers every query with a CNAME to target.example.net
+// with a TTL of ttl, counting the queries it gets.
+type countingExchanger struct {
+	queries *int
+	ttl     uint32
+}
+
+func (c countingExchanger) Exchange(_ context.Context, m *dns.Msg, _ string) (*dns.Msg, time.Duration, error) {
+	*c.queries++
+	r := new(dns.Msg)
+	r.SetReply(m)
+	r.Answer = append(r.Answer, &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: c.ttl},
+		Target: "target.example.net.",
+	})
+	return r, time.Millisecond, nil
+}
+
+func TestCachingExchanger(t *testing.T) {
+	saved := responseCache
+	responseCache = newMemoryCache()
+	defer func() { responseCache = saved }()
+
+	query := func(rd bool) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.com.", dns.TypeCNAME)
+		m.RecursionDesired = rd
+		return m
+	}
+
+	for _, tt := range []struct {
+		name string
+		ctx  context.Context
+		m    *dns.Msg
+		sent bool
+	}{
+		{"first recursive", context.Background(), query(true), true},
+		{"second recursive", context.Background(), query(true), false},
+		{"without recursion", context.Background(), query(false), true},
+		{"bypassing the cache", bypassCache(context.Background()), query(true), true},
+	} {
+		var queries int
+		c := cachingExchanger{countingExchanger{&queries, 300}}
+		r, _, err := c.Exchange(tt.ctx, tt.m, "192.0.2.53:53")
+		if err != nil || len(r.Answer) != 1 {
+			t.Fatalf("%s: got %v, %v", tt.name, r, err)
+		}
+		if r.Id != tt.m.Id {
+			t.Errorf("%s: response id %d, want %d", tt.name, r.Id, tt.m.Id)
+		}
+		if sent := queries > 0; sent != tt.sent {
+			t.Errorf("%s: sent %v, want %v", tt.name, sent, tt.sent)
+		}
+	}
+}
+
+func TestCachingExchangerZeroTTL(t *testing.T) {
+	saved := responseCache
+	cache := newMemoryCache()
+	responseCache = cache
+	defer func() { responseCache = saved }()
+
+	var queries int
+	c := cachingExchanger{countingExchanger{&queries, 0}}
+	for i := 0; i < 2; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.com.", dns.TypeCNAME)
+		if _, _, err := c.Exchange(context.Background(), m, "192.0.2.53:53"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(cache.entries) != 0 {
+		t.Errorf("%d entries cached, want none", len(cache.entries))
+	}
+	if queries != 2 {
+		t.Errorf("%d queries sent, want 2", queries)
+	}
+}
+
+func TestMemoryCacheSweep(t *testing.T) {
+	c := newMemoryCache()
+	c.set("gone", []byte("a"), -time.Second)
+	c.set("kept", []byte("b"), time.Hour)
+	if len(c.entries) != 2 {
+		t.Fatalf("%d entries before the next sweep is due, want 2", len(c.entries))
+	}
+
+	c.nextSweep = time.Now().Add(-time.Second)
+	c.set("new", []byte("c"), time.Hour)
+	if _, ok := c.entries["gone"]; ok {
+		t.Error("expired entry left after a sweep")
+	}
+	for _, k := range []string{"kept", "new"} {
+		if _, ok := c.get(k); !ok {
+			t.Errorf("%s missing after a sweep", k)
+		}
+	}
+}
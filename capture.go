@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// capturedResponse is a single line of a capture file: the raw wire-format
+// response to a query, keyed by the queried name, type and resolver.
+type capturedResponse struct {
+	Domain   string `json:"domain"`
+	QType    string `json:"qtype"`
+	Resolver string `json:"resolver"`
+	Response string `json:"response"`
+}
+
+// captureWriter records every response it sees to a capture file.
+type captureWriter struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func newCaptureWriter(path string) (*captureWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &captureWriter{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (c *captureWriter) record(m *dns.Msg, address string, r *dns.Msg) {
+	packed, err := r.Pack()
+	if err != nil || len(m.Question) == 0 {
+		return
+	}
+
+	q := m.Question[0]
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.enc.Encode(capturedResponse{
+		Domain:   strings.ToLower(q.Name),
+		QType:    dns.TypeToString[q.Qtype],
+		Resolver: address,
+		Response: base64.StdEncoding.EncodeToString(packed),
+	})
+}
+
+func (c *captureWriter) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.f.Close()
+}
+
+// capturingExchanger passes queries on to the real exchanger and records
+// the responses.
+type capturingExchanger struct {
+	exchanger
+	capture *captureWriter
+}
+
+func (c capturingExchanger) Exchange(ctx context.Context, m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	r, rtt, err := c.exchanger.Exchange(ctx, m, address)
+	if err == nil {
+		c.capture.record(m, address, r)
+	}
+	return r, rtt, err
+}
+
+// systemAddress is the resolver the system resolver's lookups are
+// recorded against.
+const systemAddress = "system"
+
+// recordAddrs records the addresses the system resolver found for host, or
+// that it found none, as responses to queries of each of qtypes. Lookups
+// that failed, and those of addresses, aren't recorded.
+func (c *captureWriter) recordAddrs(host string, addrs []string, err error, qtypes ...uint16) {
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) || net.ParseIP(host) != nil {
+		return
+	}
+
+	for _, qtype := range qtypes {
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(host), qtype)
+		r := new(dns.Msg)
+		r.SetReply(m)
+		hdr := dns.RR_Header{Name: m.Question[0].Name, Rrtype: qtype, Class: dns.ClassINET}
+		for _, a := range addrs {
+			ip := net.ParseIP(a)
+			switch {
+			case ip == nil:
+			case qtype == dns.TypeA && ip.To4() != nil:
+				r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: ip})
+			case qtype == dns.TypeAAAA && ip.To4() == nil:
+				r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+		c.record(m, systemAddress, r)
+	}
+}
+
+// capturingResolver passes address lookups on to the system resolver and
+// records what it found.
+type capturingResolver struct {
+	hostResolver
+	capture *captureWriter
+}
+
+func (c capturingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addrs, err := c.hostResolver.LookupHost(ctx, host)
+	c.capture.recordAddrs(host, addrs, err, dns.TypeA, dns.TypeAAAA)
+	return addrs, err
+}
+
+func (c capturingResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	ips, err := c.hostResolver.LookupIP(ctx, network, host)
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = ip.String()
+	}
+	c.capture.recordAddrs(host, addrs, err, addressTypes(network)...)
+	return ips, err
+}
+
+// addressTypes are the query types a lookup over network asks for.
+func addressTypes(network string) []uint16 {
+	switch network {
+	case "ip4":
+		return []uint16{dns.TypeA}
+	case "ip6":
+		return []uint16{dns.TypeAAAA}
+	}
+	return []uint16{dns.TypeA, dns.TypeAAAA}
+}
+
+// replayExchanger answers queries from a capture file without touching the
+// network. A response captured from a different resolver is used when there
+// isn't one for the exact resolver asked, since resolvers are picked at
+// random.
+type replayExchanger struct {
+	exact map[string][]byte
+	any   map[string][]byte
+}
+
+func loadReplay(path string) (*replayExchanger, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rp := &replayExchanger{
+		exact: make(map[string][]byte),
+		any:   make(map[string][]byte),
+	}
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), dns.MaxMsgSize*2)
+	for sc.Scan() {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+
+		var c capturedResponse
+		if err := json.Unmarshal(sc.Bytes(), &c); err != nil {
+			return nil, fmt.Errorf("invalid capture line: %w", err)
+		}
+		packed, err := base64.StdEncoding.DecodeString(c.Response)
+		if err != nil {
+			return nil, fmt.Errorf("invalid captured response for %s: %w", c.Domain, err)
+		}
+
+		key := replayKey(c.Domain, c.QType)
+		rp.exact[key+" "+c.Resolver] = packed
+		rp.any[key] = packed
+	}
+	return rp, sc.Err()
+}
+
+func (rp *replayExchanger) Exchange(_ context.Context, m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	if len(m.Question) == 0 {
+		return nil, 0, fmt.Errorf("no question to replay")
+	}
+
+	q := m.Question[0]
+	key := replayKey(q.Name, dns.TypeToString[q.Qtype])
+	packed, ok := rp.exact[key+" "+address]
+	if !ok {
+		packed, ok = rp.any[key]
+	}
+	if !ok {
+		return nil, 0, fmt.Errorf("no captured response for %s", key)
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(packed); err != nil {
+		return nil, 0, err
+	}
+	r.Id = m.Id
+	return r, 0, nil
+}
+
+func replayKey(domain, qtype string) string {
+	return strings.ToLower(domain) + " " + qtype
+}
+
+// replayResolver answers the address lookups that would go to the system
+// resolver from a capture file as well, using what capturingResolver
+// recorded or any other A and AAAA responses there are for the name.
+type replayResolver struct {
+	rp *replayExchanger
+}
+
+func (r replayResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	addrs, err := addrsWith(ctx, host, r.rp, systemAddress)
+	if err == nil && len(addrs) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, err
+}
+
+func (r replayResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	addrs, err := r.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		if network == "ip4" && ip.To4() == nil || network == "ip6" && ip.To4() != nil {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
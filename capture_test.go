@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// replayed is a response for useReplay to answer a query for name with.
+type replayed struct {
+	name  string
+	qtype uint16
+	rcode int
+	// answer is the answer section, in zone file format
+	answer []string
+}
+
+// useReplay writes responses to a capture file and answers every query
+// and address lookup from it, as -replay does, until the test ends. There
+// is a single resolver to pick, which nothing listens on.
+func useReplay(t *testing.T, responses ...replayed) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	capture, err := newCaptureWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rr := range responses {
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(rr.name), rr.qtype)
+		r := new(dns.Msg)
+		r.SetRcode(m, rr.rcode)
+		for _, s := range rr.answer {
+			a, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Answer = append(r.Answer, a)
+		}
+		capture.record(m, "any", r)
+	}
+	if err := capture.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rp, err := loadReplay(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, savedSystem, savedConfig, savedPool, savedCache := newExchanger, systemResolver, config, resolvers, responseCache
+	newExchanger = func(string) exchanger { return rp }
+	systemResolver = replayResolver{rp}
+	config.qtype = dns.TypeCNAME
+	config.maxDepth = 10
+	config.resolveTimeout = time.Second
+	resolvers = newResolverPool([]string{"192.0.2.53"})
+	responseCache = nil
+	t.Cleanup(func() {
+		newExchanger, systemResolver, config, resolvers, responseCache = saved, savedSystem, savedConfig, savedPool, savedCache
+	})
+}
+
+// danglingS3 is a chain ending at an S3 bucket that no longer exists.
+var danglingS3 = []replayed{
+	{name: "a.example.com", qtype: dns.TypeCNAME, answer: []string{"a.example.com. 60 IN CNAME b.example.net."}},
+	{name: "b.example.net", qtype: dns.TypeCNAME, answer: []string{"b.example.net. 60 IN CNAME gone.s3.amazonaws.com."}},
+	{name: "gone.s3.amazonaws.com", qtype: dns.TypeCNAME, rcode: dns.RcodeNameError},
+	{name: "gone.s3.amazonaws.com", qtype: dns.TypeA, rcode: dns.RcodeNameError},
+	{name: "gone.s3.amazonaws.com", qtype: dns.TypeAAAA, rcode: dns.RcodeNameError},
+}
+
+func TestReplayTakeover(t *testing.T) {
+	useReplay(t, danglingS3...)
+
+	rs := processDomain(context.Background(), job{domain: "a.example.com", server: resolvers.pick()})
+	if len(rs) != 1 {
+		t.Fatalf("got %d results, want 1: %+v", len(rs), rs)
+	}
+	r := rs[0]
+	if r.Status != statusTakeover || r.Service != "AWS S3" || r.CNAME != "gone.s3.amazonaws.com" {
+		t.Errorf("got %s %s %q, want a takeover of gone.s3.amazonaws.com on AWS S3", r.Status, r.CNAME, r.Service)
+	}
+	if want := []string{"b.example.net", "gone.s3.amazonaws.com"}; !slices.Equal(r.Chain, want) {
+		t.Errorf("chain %v, want %v", r.Chain, want)
+	}
+	if r.TTL == nil || *r.TTL != 60 {
+		t.Errorf("TTL %v, want 60", r.TTL)
+	}
+}
+
+// TestReplayResolving checks that whether a target resolves comes from the
+// capture too; the target doesn't exist anywhere else.
+func TestReplayResolving(t *testing.T) {
+	for _, via := range []string{"", "https://doh.example/dns-query"} {
+		useReplay(t,
+			replayed{name: "www.example.com", qtype: dns.TypeCNAME, answer: []string{"www.example.com. 60 IN CNAME live.s3.amazonaws.com."}},
+			replayed{name: "live.s3.amazonaws.com", qtype: dns.TypeA, answer: []string{"live.s3.amazonaws.com. 60 IN A 192.0.2.10"}},
+			replayed{name: "live.s3.amazonaws.com", qtype: dns.TypeAAAA},
+		)
+		config.maxDepth = 1
+		config.resolveViaDoH = via
+
+		rs := processDomain(context.Background(), job{domain: "www.example.com", server: resolvers.pick()})
+		if len(rs) != 1 || rs[0].Status != statusOK {
+			t.Errorf("via %q: got %+v, want a single %s result", via, rs, statusOK)
+		}
+	}
+}
+
+func TestReplayProbe(t *testing.T) {
+	useReplay(t, replayed{name: probeDomain, qtype: dns.TypeA, answer: []string{probeDomain + " 60 IN A 192.0.2.10"}})
+
+	// a probe that went to the network would time out against a resolver
+	// nobody runs
+	if l := probeLatency(resolvers.pick()); l >= probeTimeout {
+		t.Errorf("probe took %v, as long as one that failed", l)
+	}
+}
+
+func TestCapturedAddrsReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	capture, err := newCaptureWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := capturingResolver{cannedResolver{
+		"live.example.com": {"192.0.2.10", "2001:db8::10"},
+	}, capture}
+	c.LookupHost(context.Background(), "live.example.com")
+	c.LookupHost(context.Background(), "gone.example.com")
+	capture.Close()
+
+	rp, err := loadReplay(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := replayResolver{rp}
+	addrs, err := r.LookupHost(context.Background(), "live.example.com")
+	if err != nil || !slices.Equal(addrs, []string{"192.0.2.10", "2001:db8::10"}) {
+		t.Errorf("live.example.com: got %v, %v", addrs, err)
+	}
+	ips, err := r.LookupIP(context.Background(), "ip6", "live.example.com")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("2001:db8::10")) {
+		t.Errorf("live.example.com over ip6: got %v, %v", ips, err)
+	}
+	var dnsErr *net.DNSError
+	if _, err := r.LookupHost(context.Background(), "gone.example.com"); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("gone.example.com: got %v, want not found", err)
+	}
+}
+
+// TestReplayAuthoritativeCNAMEToApex checks that a domain that's a CNAME to
+// another zone's apex is looked up at its own zone's nameservers, not at the
+// ones of the zone it points into, which come along in the NS answer.
+func TestReplayAuthoritativeCNAMEToApex(t *testing.T) {
+	useReplay(t,
+		replayed{name: "www.example.com", qtype: dns.TypeNS, answer: []string{
+			"www.example.com. 60 IN CNAME other.net.",
+			"other.net. 60 IN NS ns.other.net.",
+		}},
+		replayed{name: "example.com", qtype: dns.TypeNS, answer: []string{"example.com. 60 IN NS ns.example.com."}},
+		replayed{name: "ns.example.com", qtype: dns.TypeA, answer: []string{"ns.example.com. 60 IN A 192.0.2.1"}},
+		replayed{name: "ns.example.com", qtype: dns.TypeAAAA},
+		replayed{name: "ns.other.net", qtype: dns.TypeA, answer: []string{"ns.other.net. 60 IN A 192.0.2.99"}},
+		replayed{name: "ns.other.net", qtype: dns.TypeAAAA},
+	)
+	savedZones, savedAddrs := authZones.zones, authZones.addrs
+	authZones.zones, authZones.addrs = make(map[string][]string), make(map[string]bool)
+	t.Cleanup(func() { authZones.zones, authZones.addrs = savedZones, savedAddrs })
+
+	ns, err := authoritativeServer(context.Background(), "www.example.com", resolvers.pick())
+	if err != nil || ns != "192.0.2.1" {
+		t.Errorf("got %q, %v, want example.com's nameserver 192.0.2.1", ns, err)
+	}
+	if addrs, known := authZones.zones["www.example.com."]; !known || addrs != nil {
+		t.Errorf("www.example.com cached as a zone with nameservers %v", addrs)
+	}
+}
+
+// TestReplayTargetLookupError checks that a CNAME or NS target whose lookup
+// fails is a lookup error, not dangling or taken over.
+func TestReplayTargetLookupError(t *testing.T) {
+	useReplay(t,
+		replayed{name: "www.example.com", qtype: dns.TypeCNAME, answer: []string{"www.example.com. 60 IN CNAME broken.s3.amazonaws.com."}},
+		replayed{name: "broken.s3.amazonaws.com", qtype: dns.TypeA, rcode: dns.RcodeServerFailure},
+		replayed{name: "broken.s3.amazonaws.com", qtype: dns.TypeAAAA, rcode: dns.RcodeServerFailure},
+		replayed{name: "ns.broken.example", qtype: dns.TypeA, rcode: dns.RcodeServerFailure},
+		replayed{name: "ns.broken.example", qtype: dns.TypeAAAA, rcode: dns.RcodeServerFailure},
+	)
+	config.maxDepth = 1
+
+	rs := processDomain(context.Background(), job{domain: "www.example.com", server: resolvers.pick()})
+	if len(rs) != 1 || rs[0].Status != statusLookupError || rs[0].Service != "" {
+		t.Errorf("CNAME: got %+v, want a single %s result", rs, statusLookupError)
+	}
+
+	r := checkNameserver(context.Background(), "example.com", cnameResult{target: "ns.broken.example"}, resolvers.pick())
+	if r.Status != statusLookupError {
+		t.Errorf("NS: got %s, want %s", r.Status, statusLookupError)
+	}
+}
+
+// unreachableExchanger fails every query to address, passing the rest on.
+type unreachableExchanger struct {
+	exchanger
+	address string
+}
+
+func (u unreachableExchanger) Exchange(ctx context.Context, m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	if address == u.address {
+		return nil, 0, errors.New("unreachable")
+	}
+	return u.exchanger.Exchange(ctx, m, address)
+}
+
+// TestReplayVantages checks that a target is only dangling from every
+// vantage when every resolver answers that it doesn't resolve.
+func TestReplayVantages(t *testing.T) {
+	for _, unreachable := range []string{"", "192.0.2.54:53"} {
+		useReplay(t,
+			replayed{name: "gone.example.net", qtype: dns.TypeA, rcode: dns.RcodeNameError},
+			replayed{name: "gone.example.net", qtype: dns.TypeAAAA, rcode: dns.RcodeNameError},
+		)
+		resolvers = newResolverPool([]string{"192.0.2.53", "192.0.2.54"})
+		inner := newExchanger
+		newExchanger = func(network string) exchanger {
+			return unreachableExchanger{inner(network), unreachable}
+		}
+
+		r := Result{Domain: "www.example.com", CNAME: "gone.example.net", Status: statusDangling}
+		checkVantages(context.Background(), &r)
+		want := statusDangling
+		if unreachable != "" {
+			want = statusDanglingPartial
+		}
+		if r.Status != want {
+			t.Errorf("unreachable %q: got %s (%s), want %s", unreachable, r.Status, r.Detail, want)
+		}
+	}
+}
+
+// queryCounter counts the queries passed on to exchanger.
+type queryCounter struct {
+	exchanger
+	queries *int
+}
+
+func (c queryCounter) Exchange(ctx context.Context, m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	*c.queries++
+	return c.exchanger.Exchange(ctx, m, address)
+}
+
+// TestReplayQueryAutoChain checks that -query-auto takes the whole chain
+// from the answer to its single A query.
+func TestReplayQueryAutoChain(t *testing.T) {
+	useReplay(t, replayed{name: "a.example.com", qtype: dns.TypeA, answer: []string{
+		"a.example.com. 60 IN CNAME b.example.net.",
+		"b.example.net. 30 IN CNAME live.s3.amazonaws.com.",
+		"live.s3.amazonaws.com. 60 IN A 192.0.2.10",
+	}})
+	config.queryAuto = true
+	var queries int
+	inner := newExchanger
+	newExchanger = func(network string) exchanger { return queryCounter{inner(network), &queries} }
+
+	rs := processDomain(context.Background(), job{domain: "a.example.com", server: resolvers.pick()})
+	if len(rs) != 1 {
+		t.Fatalf("got %d results, want 1: %+v", len(rs), rs)
+	}
+	r := rs[0]
+	if r.Status != statusOK || r.CNAME != "live.s3.amazonaws.com" {
+		t.Errorf("got %s %q, want %s live.s3.amazonaws.com", r.Status, r.CNAME, statusOK)
+	}
+	if want := []string{"b.example.net", "live.s3.amazonaws.com"}; !slices.Equal(r.Chain, want) {
+		t.Errorf("chain %v, want %v", r.Chain, want)
+	}
+	if r.TTL == nil || *r.TTL != 60 {
+		t.Errorf("TTL %v, want 60", r.TTL)
+	}
+	if queries != 1 {
+		t.Errorf("%d queries, want 1", queries)
+	}
+}
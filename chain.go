@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// followChain follows res, the CNAME lookup for a domain, through any
+// further CNAMEs its target has until reaching a name without one, giving
+// up once the chain is config.maxDepth links long or loops. The result
+// describes the last link, with chain holding every target in order, but
+// keeps the TTL of the domain's own CNAME.
+func followChain(ctx context.Context, res cnameResult, server string) cnameResult {
+	ttl := res.ttl
+	chain := []string{res.target}
+	seen := map[string]bool{normalizeName(res.target): true}
+
+	for len(chain) < config.maxDepth && ctx.Err() == nil {
+		next, err := getCNAMEWithRetry(ctx, strings.TrimSuffix(res.target, "."), server)
+		if err != nil || next.target == "" {
+			break
+		}
+		if n := normalizeName(next.target); seen[n] {
+			break
+		} else {
+			seen[n] = true
+		}
+
+		chain = append(chain, next.target)
+		res = next
+	}
+
+	if len(chain) > 1 {
+		res.chain = chain
+	}
+	res.ttl = ttl
+	return res
+}
+
+// answerChain returns the CNAME chain from domain as the records in r's
+// answer give it, which a recursive resolver fills in whole when asked for
+// an address: every target in order, up to config.maxDepth links and
+// stopping short of a loop.
+func answerChain(r *dns.Msg, domain string) []string {
+	var chain []string
+	seen := map[string]bool{normalizeName(domain): true}
+	for name := domain; len(chain) < config.maxDepth; {
+		target := ""
+		for _, ans := range r.Answer {
+			if cname, ok := ans.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				target = cname.Target
+				break
+			}
+		}
+		if target == "" || seen[normalizeName(target)] {
+			break
+		}
+		seen[normalizeName(target)] = true
+		chain = append(chain, target)
+		name = target
+	}
+	return chain
+}
+
+// normalizeName lowercases name and strips the trailing dot, the form
+// targets are compared and reported in.
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
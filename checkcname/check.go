@@ -0,0 +1,181 @@
+// Package checkcname checks whether a domain's CNAME points at a target
+// that no longer exists, and whether that target belongs to a service
+// known to be prone to subdomain takeover.
+//
+// It's the core of the check-cnames command, which adds its many options
+// (retries, resolver pools, HTTP verification and so on) on top.
+package checkcname
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Statuses a Result can have.
+const (
+	// StatusOK is a CNAME whose target resolves.
+	StatusOK = "ok"
+	// StatusTakeover is a CNAME whose target's service shows it to be
+	// unclaimed; for most services that's the target not resolving.
+	StatusTakeover = "takeover"
+	// StatusDangling is a CNAME whose target doesn't resolve.
+	StatusDangling = "dangling"
+	// StatusService is a CNAME whose target resolves and belongs to a
+	// known service.
+	StatusService = "service"
+	// StatusNeedsConfirmation is a CNAME whose target doesn't resolve and
+	// belongs to a service whose unclaimed targets only its HTTP
+	// fingerprint shows, which wasn't looked for.
+	StatusNeedsConfirmation = "needs-confirmation"
+)
+
+const (
+	defaultResolver = "8.8.8.8"
+	defaultTimeout  = 5 * time.Second
+)
+
+// ErrNoCNAME is returned by Check for a domain without a CNAME.
+var ErrNoCNAME = errors.New("no CNAME")
+
+// Options configures Check. The zero value asks 8.8.8.8 with a 5 second
+// timeout, checks the target with the system resolver and matches against
+// DefaultServices.
+type Options struct {
+	// Resolver is the recursive resolver to ask for the CNAME, as an IP
+	// address with an optional port.
+	Resolver string
+	Timeout  time.Duration
+	Services []Service
+
+	// CNAME is the domain's CNAME target when it's already known, in
+	// which case it isn't looked up.
+	CNAME string
+
+	// Resolves reports whether target resolves, lowercased and without
+	// the trailing dot; an error means it couldn't be told. By default
+	// the system resolver is asked, and any address counts.
+	Resolves func(ctx context.Context, target string) (bool, error)
+}
+
+// Result is the outcome of checking a single domain.
+type Result struct {
+	Domain string `json:"domain"`
+	// CNAME is the target, lowercased and without the trailing dot
+	CNAME   string `json:"cname"`
+	Status  string `json:"status"`
+	Service string `json:"service,omitempty"`
+	// Confidence is how likely a takeover is to be real
+	Confidence Confidence `json:"confidence,omitempty"`
+}
+
+// Check looks up the CNAME of domain and whether its target resolves, and
+// decides what that means by the Detection of the target's service. A
+// service detected by its HTTP fingerprint can't be told to be unclaimed
+// without fetching it, which Check doesn't do, so its dangling targets only
+// need confirmation. The error is ErrNoCNAME (wrapped) when domain has
+// no CNAME, or whatever went wrong with the lookups.
+func Check(ctx context.Context, domain string, opts Options) (Result, error) {
+	if opts.Resolver == "" {
+		opts.Resolver = defaultResolver
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.Services == nil {
+		opts.Services = defaultServices
+	}
+	if opts.Resolves == nil {
+		opts.Resolves = func(ctx context.Context, target string) (bool, error) {
+			return systemResolves(ctx, target, opts.Timeout)
+		}
+	}
+
+	r := Result{Domain: normalize(domain)}
+	target := opts.CNAME
+	if target == "" {
+		var err error
+		if target, err = lookupCNAME(ctx, r.Domain, resolverAddr(opts.Resolver), opts.Timeout); err != nil {
+			return r, err
+		}
+	}
+	r.CNAME = normalize(target)
+
+	resolved, err := opts.Resolves(ctx, r.CNAME)
+	if err != nil {
+		return r, err
+	}
+
+	s, ok := matchService(opts.Services, r.CNAME)
+	switch {
+	case !ok && resolved:
+		r.Status = StatusOK
+	case !ok:
+		r.Status = StatusDangling
+	case s.Detects() == DetectPattern, s.Detects() == DetectNXDomain && !resolved:
+		r.Status = StatusTakeover
+		r.Confidence = s.TakeoverConfidence(false)
+	case resolved:
+		r.Status = StatusService
+	default:
+		r.Status = StatusNeedsConfirmation
+	}
+	if ok {
+		r.Service = s.Name
+	}
+	return r, nil
+}
+
+func normalize(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// systemResolves asks the system resolver whether target has any address.
+func systemResolves(ctx context.Context, target string, timeout time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, target)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return len(addrs) > 0, nil
+}
+
+func lookupCNAME(ctx context.Context, domain, address string, timeout time.Duration) (string, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(domain), dns.TypeCNAME)
+	m.RecursionDesired = true
+
+	c := &dns.Client{Timeout: timeout}
+	resp, _, err := c.ExchangeContext(ctx, m, address)
+	if err != nil {
+		return "", err
+	}
+	for _, ans := range resp.Answer {
+		if cname, ok := ans.(*dns.CNAME); ok {
+			return cname.Target, nil
+		}
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return "", fmt.Errorf("%s for %s", dns.RcodeToString[resp.Rcode], domain)
+	}
+	return "", fmt.Errorf("%w for %s", ErrNoCNAME, domain)
+}
+
+// resolverAddr adds the DNS port to resolver unless it already has one.
+func resolverAddr(resolver string) string {
+	if _, _, err := net.SplitHostPort(resolver); err == nil {
+		return resolver
+	}
+	return net.JoinHostPort(resolver, "53")
+}
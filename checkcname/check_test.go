@@ -0,0 +1,59 @@
+package checkcname
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	services := []Service{
+		{Name: "Bucket", Patterns: []string{"bucket.example"}, Confidence: ConfidenceHigh},
+		{Name: "Pages", Patterns: []string{"pages.example"}, Probe: &HTTPProbe{Signatures: []string{"no such site"}}, Detection: DetectHTTP},
+		{Name: "Edge", Patterns: []string{"edge.example"}, Detection: DetectPattern},
+	}
+
+	for _, tt := range []struct {
+		cname      string
+		resolved   bool
+		status     string
+		service    string
+		confidence Confidence
+	}{
+		{"www.example.net.", true, StatusOK, "", ""},
+		{"gone.example.net.", false, StatusDangling, "", ""},
+		{"Gone.Bucket.Example.", false, StatusTakeover, "Bucket", ConfidenceHigh},
+		{"live.bucket.example", true, StatusService, "Bucket", ""},
+		// only the fingerprint shows whether these are unclaimed
+		{"gone.pages.example", false, StatusNeedsConfirmation, "Pages", ""},
+		{"live.pages.example", true, StatusService, "Pages", ""},
+		{"live.edge.example", true, StatusTakeover, "Edge", ConfidenceLow},
+	} {
+		r, err := Check(context.Background(), "www.example.com.", Options{
+			CNAME:    tt.cname,
+			Services: services,
+			Resolves: func(context.Context, string) (bool, error) { return tt.resolved, nil },
+		})
+		if err != nil {
+			t.Errorf("%s: %v", tt.cname, err)
+			continue
+		}
+		if r.Domain != "www.example.com" || r.CNAME != normalize(tt.cname) {
+			t.Errorf("%s: got %s -> %s", tt.cname, r.Domain, r.CNAME)
+		}
+		if r.Status != tt.status || r.Service != tt.service || r.Confidence != tt.confidence {
+			t.Errorf("%s: got %s %q %q, want %s %q %q", tt.cname, r.Status, r.Service, r.Confidence, tt.status, tt.service, tt.confidence)
+		}
+	}
+}
+
+func TestCheckResolveError(t *testing.T) {
+	failed := errors.New("SERVFAIL")
+	_, err := Check(context.Background(), "www.example.com", Options{
+		CNAME:    "gone.bucket.example",
+		Resolves: func(context.Context, string) (bool, error) { return false, failed },
+	})
+	if !errors.Is(err, failed) {
+		t.Errorf("got %v, want %v", err, failed)
+	}
+}
@@ -0,0 +1,289 @@
+package checkcname
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Service describes a third-party provider that is prone to subdomain
+// takeover. Targets are matched against Patterns by suffix; providers whose
+// CNAME targets are too generic to match can also list the address ranges
+// their shared ingress lives in. Detection says what shows that a target
+// matching the service is unclaimed, and Confidence how likely that makes
+// it that the target can really be claimed.
+type Service struct {
+	Name       string
+	Patterns   []string
+	Ranges     []*net.IPNet
+	Probe      *HTTPProbe
+	Detection  Detection
+	Confidence Confidence
+}
+
+// Confidence is how likely a takeover finding is to be real.
+type Confidence string
+
+const (
+	// ConfidenceHigh findings are almost always claimable, such as ones an
+	// HTTP fingerprint confirmed.
+	ConfidenceHigh Confidence = "high"
+	// ConfidenceMedium findings usually are.
+	ConfidenceMedium Confidence = "medium"
+	// ConfidenceLow findings need checking by hand.
+	ConfidenceLow Confidence = "low"
+)
+
+// ParseConfidence parses one of high, medium or low. An empty string is
+// ConfidenceMedium.
+func ParseConfidence(s string) (Confidence, error) {
+	switch c := Confidence(strings.ToLower(s)); c {
+	case "":
+		return ConfidenceMedium, nil
+	case ConfidenceHigh, ConfidenceMedium, ConfidenceLow:
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown confidence %q", s)
+}
+
+// Detection is how an unclaimed target at a service is recognised.
+type Detection string
+
+const (
+	// DetectNXDomain services are unclaimed when the target doesn't
+	// resolve. It's what the zero value means.
+	DetectNXDomain Detection = "nxdomain"
+	// DetectHTTP services are unclaimed when the domain serves one of the
+	// Probe's signatures; whether the target resolves says nothing either
+	// way.
+	DetectHTTP Detection = "http"
+	// DetectPattern services are unclaimed whenever the target matches
+	// one of the Patterns.
+	DetectPattern Detection = "pattern"
+)
+
+// ParseDetection parses one of nxdomain, http or pattern. An empty string
+// is DetectNXDomain.
+func ParseDetection(s string) (Detection, error) {
+	switch d := Detection(strings.ToLower(s)); d {
+	case "":
+		return DetectNXDomain, nil
+	case DetectNXDomain, DetectHTTP, DetectPattern:
+		return d, nil
+	}
+	return "", fmt.Errorf("unknown detection method %q", s)
+}
+
+// Detects returns the service's detection method, DetectNXDomain unless
+// Detection says otherwise.
+func (s Service) Detects() Detection {
+	if s.Detection == "" {
+		return DetectNXDomain
+	}
+	return s.Detection
+}
+
+// Confident returns how likely a takeover found by the service's
+// detection method is to be real, ConfidenceMedium unless Confidence says
+// otherwise.
+func (s Service) Confident() Confidence {
+	if s.Confidence == "" {
+		return ConfidenceMedium
+	}
+	return s.Confidence
+}
+
+// TakeoverConfidence returns how likely a takeover at the service is to be
+// real: high when an HTTP fingerprint confirmed it, low when the target
+// only matched one of the Patterns, and Confident otherwise.
+func (s Service) TakeoverConfidence(fingerprinted bool) Confidence {
+	switch {
+	case fingerprinted:
+		return ConfidenceHigh
+	case s.Detects() == DetectPattern:
+		return ConfidenceLow
+	}
+	return s.Confident()
+}
+
+// HTTPProbe describes the request that shows whether a domain pointed at a
+// service is unclaimed, and the signatures (any of which) the response then
+// contains. Method defaults to GET, Path to "/" and Host to the domain being
+// checked.
+type HTTPProbe struct {
+	Method     string
+	Path       string
+	Host       string
+	Signatures []string
+}
+
+// CloudFront is the name of the AWS CloudFront service, which needs more
+// than a signature to verify.
+const CloudFront = "AWS CloudFront"
+
+// DefaultServices returns the built-in services. Each call returns a new
+// slice, so it's safe to modify.
+func DefaultServices() []Service {
+	return append([]Service(nil), defaultServices...)
+}
+
+var defaultServices = []Service{
+	{
+		Name: "AWS S3",
+		Patterns: []string{
+			"s3.amazonaws.com",
+			"s3-website-us-east-1.amazonaws.com",
+			"s3-website-us-west-1.amazonaws.com",
+			"s3-website-us-west-2.amazonaws.com",
+			"s3-website-eu-west-1.amazonaws.com",
+			"s3-website.eu-central-1.amazonaws.com",
+			"s3-website-ap-southeast-1.amazonaws.com",
+			"s3-website-ap-southeast-2.amazonaws.com",
+			"s3-website-ap-northeast-1.amazonaws.com",
+		},
+		Probe:      &HTTPProbe{Signatures: []string{"NoSuchBucket"}},
+		Detection:  DetectNXDomain,
+		Confidence: ConfidenceMedium,
+	},
+	{
+		Name:      CloudFront,
+		Patterns:  []string{"cloudfront.net"},
+		Detection: DetectNXDomain,
+		// a dangling distribution name often just hasn't been deleted yet
+		Confidence: ConfidenceLow,
+	},
+	{
+		Name:       "GitHub Pages",
+		Patterns:   []string{"github.io"},
+		Ranges:     cidrs("185.199.108.0/22"),
+		Probe:      &HTTPProbe{Signatures: []string{"There isn't a GitHub Pages site here"}},
+		Detection:  DetectHTTP,
+		Confidence: ConfidenceHigh,
+	},
+	{
+		Name:       "Heroku",
+		Patterns:   []string{"herokuapp.com", "herokudns.com", "herokussl.com"},
+		Probe:      &HTTPProbe{Signatures: []string{"no-such-app.html"}},
+		Detection:  DetectHTTP,
+		Confidence: ConfidenceHigh,
+	},
+	{
+		Name: "Microsoft Azure",
+		Patterns: []string{
+			"azurewebsites.net",
+			"cloudapp.net",
+			"cloudapp.azure.com",
+			"trafficmanager.net",
+			"blob.core.windows.net",
+			"azureedge.net",
+		},
+		Detection:  DetectNXDomain,
+		Confidence: ConfidenceMedium,
+	},
+	{
+		Name:       "Shopify",
+		Patterns:   []string{"myshopify.com"},
+		Ranges:     cidrs("23.227.38.0/24"),
+		Probe:      &HTTPProbe{Signatures: []string{"Sorry, this shop is currently unavailable"}},
+		Detection:  DetectHTTP,
+		Confidence: ConfidenceHigh,
+	},
+	{
+		Name:       "Fastly",
+		Patterns:   []string{"fastly.net"},
+		Ranges:     cidrs("151.101.0.0/16"),
+		Probe:      &HTTPProbe{Signatures: []string{"Fastly error: unknown domain"}},
+		Detection:  DetectHTTP,
+		Confidence: ConfidenceHigh,
+	},
+	{
+		Name:       "Netlify",
+		Patterns:   []string{"netlify.app", "netlify.com"},
+		Ranges:     cidrs("75.2.60.5/32"),
+		Probe:      &HTTPProbe{Signatures: []string{"Not Found - Request ID"}},
+		Detection:  DetectHTTP,
+		Confidence: ConfidenceHigh,
+	},
+	{
+		Name:       "Pantheon",
+		Patterns:   []string{"pantheonsite.io"},
+		Probe:      &HTTPProbe{Signatures: []string{"The gods are wise"}},
+		Detection:  DetectHTTP,
+		Confidence: ConfidenceHigh,
+	},
+	{
+		Name:       "Tumblr",
+		Patterns:   []string{"domains.tumblr.com"},
+		Probe:      &HTTPProbe{Signatures: []string{"Whatever you were looking for doesn't currently exist at this address"}},
+		Detection:  DetectHTTP,
+		Confidence: ConfidenceHigh,
+	},
+	{
+		// the root only redirects to the help center, and redirects
+		// aren't followed
+		Name:       "Zendesk",
+		Patterns:   []string{"zendesk.com"},
+		Probe:      &HTTPProbe{Path: "/hc/en-us", Signatures: []string{"Help Center Closed"}},
+		Detection:  DetectHTTP,
+		Confidence: ConfidenceHigh,
+	},
+	{
+		Name:       "Ghost",
+		Patterns:   []string{"ghost.io"},
+		Probe:      &HTTPProbe{Signatures: []string{"The thing you were looking for is no longer here"}},
+		Detection:  DetectHTTP,
+		Confidence: ConfidenceHigh,
+	},
+	{
+		Name:       "Surge.sh",
+		Patterns:   []string{"surge.sh"},
+		Probe:      &HTTPProbe{Signatures: []string{"project not found"}},
+		Detection:  DetectHTTP,
+		Confidence: ConfidenceHigh,
+	},
+	{
+		Name:       "Bitbucket",
+		Patterns:   []string{"bitbucket.io"},
+		Probe:      &HTTPProbe{Signatures: []string{"Repository not found"}},
+		Detection:  DetectHTTP,
+		Confidence: ConfidenceHigh,
+	},
+	{
+		Name:       "Unbounce",
+		Patterns:   []string{"unbouncepages.com"},
+		Probe:      &HTTPProbe{Signatures: []string{"The requested URL was not found on this server"}},
+		Detection:  DetectHTTP,
+		Confidence: ConfidenceHigh,
+	},
+}
+
+// MatchService returns the name of the first of services whose patterns
+// match target, or an empty string if there is none. target is expected
+// lowercased and without the trailing dot.
+func MatchService(services []Service, target string) string {
+	s, _ := matchService(services, target)
+	return s.Name
+}
+
+func matchService(services []Service, target string) (Service, bool) {
+	for _, s := range services {
+		for _, p := range s.Patterns {
+			if target == p || strings.HasSuffix(target, "."+p) {
+				return s, true
+			}
+		}
+	}
+	return Service{}, false
+}
+
+func cidrs(ranges ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(ranges))
+	for _, r := range ranges {
+		_, n, err := net.ParseCIDR(r)
+		if err != nil {
+			panic("invalid service range " + r)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// checkCloaking asks server for the CNAME of domain again, this time as if
+// from config.cloakingSubnet via EDNS client subnet, and reports whether
+// the answer differs from target. Trackers using CNAME cloaking sometimes
+// only hand out their CNAME to (or hide it from) particular networks.
+//
+// This only finds anything against resolvers that pass ECS on to the
+// authoritative servers; of the default resolvers that's Google's, while
+// Cloudflare's never send it.
+func checkCloaking(ctx context.Context, domain, server, target string) (Result, bool) {
+	res, err := queryCNAMEFrom(ctx, domain, server, "udp", config.cloakingSubnet)
+	if err != nil && !errors.Is(err, errNoCNAME) {
+		return Result{}, false
+	}
+
+	target = strings.ToLower(strings.TrimSuffix(target, "."))
+	ecsTarget := strings.ToLower(strings.TrimSuffix(res.target, "."))
+	if target == ecsTarget {
+		return Result{}, false
+	}
+
+	return Result{
+		Domain:   domain,
+		CNAME:    orNone(target),
+		Status:   statusCloaking,
+		Detail:   fmt.Sprintf("ecs %s: %s", config.cloakingSubnet, orNone(ecsTarget)),
+		Resolver: server,
+	}, true
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// Ways of remembering the domains already read for -dedup-mode.
+const (
+	dedupMemory = "memory"
+	dedupBloom  = "bloom"
+)
+
+// bloomErrorRate is the share of new domains a bloom filter filled to its
+// capacity wrongly takes for ones already seen, and so skips.
+const bloomErrorRate = 0.001
+
+// seenSet remembers the domains read so far.
+type seenSet interface {
+	// add records name, reporting whether it was already there
+	add(name string) bool
+}
+
+// newSeenSet returns the set for mode, one of the dedup modes, sized for
+// capacity domains if it needs to be.
+func newSeenSet(mode string, capacity uint64) seenSet {
+	if mode == dedupBloom {
+		return newBloomFilter(capacity, bloomErrorRate)
+	}
+	return memorySet{}
+}
+
+// memorySet keeps every domain, so it never skips one by mistake but grows
+// with the input.
+type memorySet map[string]bool
+
+func (s memorySet) add(name string) bool {
+	if s[name] {
+		return true
+	}
+	s[name] = true
+	return false
+}
+
+// bloomFilter takes a fixed amount of memory however many domains are
+// added, at the cost of now and then taking a new one for one already seen.
+// That happens more often the further past its capacity it's filled.
+type bloomFilter struct {
+	bits   []uint64
+	m      uint64
+	hashes uint64
+}
+
+// newBloomFilter sizes a filter for n names at false positive rate p.
+func newBloomFilter(n uint64, p float64) *bloomFilter {
+	if n == 0 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+	return &bloomFilter{bits: make([]uint64, (m+63)/64), m: m, hashes: k}
+}
+
+func (f *bloomFilter) add(name string) bool {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	sum := h.Sum64()
+	// every bit position is derived from the two halves of one hash
+	h1, h2 := sum&0xffffffff, sum>>32|1
+
+	present := true
+	for i := uint64(0); i < f.hashes; i++ {
+		bit := (h1 + i*h2) % f.m
+		word, mask := bit/64, uint64(1)<<(bit%64)
+		if f.bits[word]&mask == 0 {
+			present = false
+			f.bits[word] |= mask
+		}
+	}
+	return present
+}
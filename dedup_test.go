@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSeenSet(t *testing.T) {
+	const n = 10000
+	for _, tt := range []struct {
+		mode     string
+		capacity uint64
+		// maxFalse is the most new names the set may take for seen ones
+		maxFalse int
+	}{
+		{dedupMemory, 0, 0},
+		{dedupBloom, n, n * bloomErrorRate * 5},
+		// filled far past its capacity a filter skips more new names, but
+		// still never lets a seen one through
+		{dedupBloom, n / 100, n},
+		{dedupBloom, 0, n},
+	} {
+		s := newSeenSet(tt.mode, tt.capacity)
+		falsePositives := 0
+		for i := range n {
+			if s.add(fmt.Sprintf("host%d.example.com", i)) {
+				falsePositives++
+			}
+		}
+		if falsePositives > tt.maxFalse {
+			t.Errorf("%s with capacity %d: %d of %d new names taken as seen, want at most %d",
+				tt.mode, tt.capacity, falsePositives, n, tt.maxFalse)
+		}
+
+		for i := range n {
+			if name := fmt.Sprintf("host%d.example.com", i); !s.add(name) {
+				t.Errorf("%s with capacity %d: %s added again wasn't seen", tt.mode, tt.capacity, name)
+				break
+			}
+		}
+	}
+}
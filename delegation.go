@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// findZoneCut walks up from name until it finds the zone name belongs to,
+// asking server (a recursive resolver) for NS records at each step. It
+// returns the zone and its nameservers. A SERVFAIL part way up is reported
+// as an error since it usually means the delegation at that point is
+// broken.
+func findZoneCut(ctx context.Context, name, server string) (string, []string, error) {
+	labels := dns.SplitDomainName(name)
+	for i := range labels {
+		zone := dns.Fqdn(strings.Join(labels[i:], "."))
+		ns, err := nsAt(ctx, zone, server)
+		if err != nil {
+			return zone, nil, err
+		}
+		if len(ns) > 0 {
+			return zone, ns, nil
+		}
+	}
+	return "", nil, fmt.Errorf("no zone found for %s", name)
+}
+
+// nsAt asks server for the NS records of zone, returning none if zone isn't
+// a zone cut. Only records owned by zone itself count: a name that's a
+// CNAME to another zone's apex is answered with that zone's NS records.
+func nsAt(ctx context.Context, zone, server string) ([]string, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(zone, dns.TypeNS)
+	m.RecursionDesired = true
+
+	c, address := dial(server, "udp")
+	r, _, err := c.Exchange(ctx, m, address)
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode == dns.RcodeServerFailure {
+		return nil, fmt.Errorf("SERVFAIL for NS of %s", zone)
+	}
+
+	var ns []string
+	for _, ans := range r.Answer {
+		if rr, ok := ans.(*dns.NS); ok && strings.EqualFold(rr.Hdr.Name, zone) {
+			ns = append(ns, rr.Ns)
+		}
+	}
+	return ns, nil
+}
+
+// isAuthoritative reports whether nameserver host answers authoritatively
+// for zone.
+func isAuthoritative(ctx context.Context, zone, host string) bool {
+	// every nameserver is asked the same question
+	ctx = bypassCache(ctx)
+
+	addrs, err := systemResolver.LookupHost(ctx, strings.TrimSuffix(host, "."))
+	if err != nil {
+		return false
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(zone, dns.TypeSOA)
+	m.RecursionDesired = false
+
+	for _, addr := range addrs {
+		r, _, err := newExchanger("udp").Exchange(ctx, m, net.JoinHostPort(addr, "53"))
+		if err != nil {
+			continue
+		}
+		if r.Authoritative && r.Rcode == dns.RcodeSuccess {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDelegation reports whether the zone name lives in is broken; either
+// the resolver can't get through the delegation at all or none of the
+// zone's nameservers answer authoritatively for it. The returned string
+// describes what's wrong.
+func checkDelegation(ctx context.Context, name, server string) (string, bool) {
+	zone, ns, err := findZoneCut(ctx, name, server)
+	if err != nil {
+		if zone == "" {
+			return "", false
+		}
+		return fmt.Sprintf("zone %s: %s", strings.TrimSuffix(zone, "."), err), true
+	}
+
+	for _, host := range ns {
+		if isAuthoritative(ctx, zone, host) {
+			return "", false
+		}
+	}
+	return fmt.Sprintf("zone %s: no authoritative nameserver", strings.TrimSuffix(zone, ".")), true
+}
+
+// checkNameserver checks the nameserver that domain's NS record res points
+// at. One that doesn't resolve can be registered by anyone, and one that
+// doesn't answer authoritatively for domain, a lame delegation, can often
+// have the zone created on it by anyone with an account at its provider.
+// One whose addresses couldn't be looked up at all is a lookup error.
+func checkNameserver(ctx context.Context, domain string, res cnameResult, server string) Result {
+	r := targetResult(domain, res, server)
+	addrs, err := resolves(ctx, r.CNAME)
+	switch {
+	case lookupFailed(err):
+		lookupError(ctx, &r, err)
+		return r
+	case len(addrs) == 0:
+		r.Detail = "nameserver doesn't resolve"
+	case !isAuthoritative(ctx, dns.Fqdn(domain), r.CNAME):
+		r.Detail = "lame delegation"
+	default:
+		r.Status = statusOK
+		return r
+	}
+
+	r.Status = statusNSTakeover
+	r.Service = checkVulnerableService(r.CNAME)
+	return r
+}
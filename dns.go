@@ -0,0 +1,567 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
+)
+
+// families is the set of address families a name has records for.
+type families uint8
+
+const (
+	familyIPv4 families = 1 << iota
+	familyIPv6
+)
+
+// resolves reports whether a name with addresses in f counts as resolving;
+// with any address at all or, with config.requireBoth, only with both IPv4
+// and IPv6 ones.
+func (f families) resolves() bool {
+	if config.requireBoth {
+		return f == familyIPv4|familyIPv6
+	}
+	return f != 0
+}
+
+func (f families) String() string {
+	switch f {
+	case familyIPv4:
+		return "IPv4 only"
+	case familyIPv6:
+		return "IPv6 only"
+	case familyIPv4 | familyIPv6:
+		return "IPv4 and IPv6"
+	}
+	return "no addresses"
+}
+
+// familiesOf returns the address families of addrs.
+func familiesOf(addrs []string) families {
+	var f families
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip == nil {
+			continue
+		} else if ip.To4() != nil {
+			f |= familyIPv4
+		} else {
+			f |= familyIPv6
+		}
+	}
+	return f
+}
+
+// resolves returns the addresses domain resolves to, remembering them in
+// responseCache if there is one. Only lookups that succeeded or found that
+// domain doesn't exist are remembered, and once ctx is done nothing is
+// looked up at all.
+func resolves(ctx context.Context, domain string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if responseCache == nil {
+		return lookupAddrs(ctx, domain)
+	}
+
+	key := "addrs " + domain
+	if v, ok := responseCache.get(key); ok {
+		stats.cacheHits.Add(1)
+		return strings.Fields(string(v)), nil
+	}
+	stats.cacheMisses.Add(1)
+
+	addrs, err := lookupAddrs(ctx, domain)
+	// a lookup cut short by ctx can look like one that found nothing
+	if ctx.Err() == nil && !lookupFailed(err) {
+		responseCache.set(key, []byte(strings.Join(addrs, " ")), resolvesCacheTTL)
+	}
+	return addrs, err
+}
+
+// lookupFailed reports whether err from resolves means the lookup itself
+// failed, rather than that it found no addresses.
+func lookupFailed(err error) bool {
+	var dnsErr *net.DNSError
+	return err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound)
+}
+
+// lookupAddrs asks the system resolver or, with config.resolveViaDoH, that
+// DoH endpoint for the addresses of domain, giving it config.resolveTimeout
+// or whatever is left of ctx's deadline if that's sooner, and returning as
+// soon as ctx is done.
+func lookupAddrs(ctx context.Context, domain string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.resolveTimeout)
+	defer cancel()
+
+	if config.resolveViaDoH != "" {
+		c, address := dial(config.resolveViaDoH, "https")
+		return addrsWith(ctx, domain, c, address)
+	}
+	return systemResolver.LookupHost(ctx, domain)
+}
+
+// hostResolver looks up the addresses of names the way the system does.
+type hostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// systemResolver is what every address lookup that doesn't go to a chosen
+// resolver is made with. Like newExchanger it can be swapped out for a fake
+// that gives canned answers, and -capture and -replay wrap it like they do
+// newExchanger.
+var systemResolver hostResolver = net.DefaultResolver
+
+// exchanger sends a query to a server, giving up once ctx is done. Normally
+// it's a dns.Client but newExchanger can hand out one that records or
+// replays responses instead, or gives canned ones.
+type exchanger interface {
+	Exchange(ctx context.Context, m *dns.Msg, address string) (*dns.Msg, time.Duration, error)
+}
+
+// dnsClient is a dns.Client as an exchanger. dns.Client only takes ctx's
+// deadline into account, so the connection is also cut short as soon as ctx
+// is cancelled.
+type dnsClient struct {
+	c *dns.Client
+}
+
+func (d dnsClient) Exchange(ctx context.Context, m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	conn, err := d.c.DialContext(ctx, address)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	r, rtt, err := d.c.ExchangeWithConnContext(ctx, m, conn)
+	if ctx.Err() != nil {
+		return nil, rtt, ctx.Err()
+	}
+	return r, rtt, err
+}
+
+var newExchanger = func(network string) exchanger {
+	if network == "https" {
+		return doh
+	}
+	return dnsClient{&dns.Client{Net: network, Timeout: config.timeout}}
+}
+
+// isDoH reports whether server is a DNS over HTTPS endpoint rather than an
+// address.
+func isDoH(server string) bool {
+	return strings.HasPrefix(server, "https://")
+}
+
+// dial returns the exchanger and address to query server with over network.
+// DNS over HTTPS endpoints are always queried over HTTPS whatever network
+// asks for. A server without a port is on 53; DNS over TLS always goes to
+// 853 on the same host.
+func dial(server, network string) (exchanger, string) {
+	if isDoH(server) {
+		return newExchanger("https"), server
+	}
+	host, port := server, "53"
+	if h, p, err := net.SplitHostPort(server); err == nil {
+		host, port = h, p
+	}
+	if network == "tcp-tls" {
+		port = "853"
+	}
+	return newExchanger(network), net.JoinHostPort(host, port)
+}
+
+var (
+	errNoCNAME   = errors.New("no cname")
+	errTruncated = errors.New("truncated response")
+
+	// errEmptyAnswer is a NOERROR response with nothing in either the answer
+	// or authority sections; a real "no CNAME" answer carries an SOA, so
+	// some misbehaving resolvers send these instead of an error.
+	errEmptyAnswer = fmt.Errorf("%w: empty answer", errNoCNAME)
+
+	// errNXDomain is a definitive "no such name", so it's still no CNAME;
+	// SERVFAIL and REFUSED only say the resolver couldn't or wouldn't answer
+	errNXDomain = fmt.Errorf("%w: NXDOMAIN", errNoCNAME)
+	errServfail = errors.New("SERVFAIL")
+	errRefused  = errors.New("REFUSED")
+)
+
+// resolution records whether a CNAME target is known to resolve.
+type resolution int
+
+const (
+	resolutionUnknown resolution = iota
+	resolutionResolves
+	resolutionDangling
+)
+
+// cnameResult is the outcome of a CNAME query.
+type cnameResult struct {
+	target string
+	// rcode of the response, or -1 if there wasn't one
+	rcode int
+	// resolution is set when the response itself showed whether target
+	// resolves, sparing a separate lookup
+	resolution resolution
+	// chain is every target from the domain's own CNAME to target when
+	// there was more than one CNAME to follow
+	chain []string
+	// server is the resolver getCNAMEWithRetry asked last
+	server string
+	// ttl is the CNAME record's TTL when it came from a response
+	ttl *uint32
+	// targets is every name the answer pointed at, when querying for a
+	// type other than CNAME; target is the first of them
+	targets []recordTarget
+}
+
+// recordTarget is the name a record points at, and the record's type.
+type recordTarget struct {
+	name   string
+	rrtype uint16
+}
+
+// inFlight coalesces identical CNAME lookups for -coalesce.
+var inFlight singleflight.Group
+
+// getCNAME looks up domain's CNAME against server. With config.coalesce,
+// callers asking the same server the same question at the same time share
+// a single lookup, which runs until it's done even if the caller that
+// started it gives up; the others still stop waiting once their own ctx is
+// done.
+func getCNAME(ctx context.Context, domain, server string) (cnameResult, error) {
+	network := "udp"
+	if config.tcp {
+		network = "tcp"
+	}
+	if !config.coalesce {
+		return lookupCNAME(ctx, domain, server, network)
+	}
+
+	key := strings.Join([]string{normalizeName(domain), dns.TypeToString[config.qtype], server, network}, " ")
+	shared := context.WithoutCancel(ctx)
+	ch := inFlight.DoChan(key, func() (any, error) {
+		return lookupCNAME(shared, domain, server, network)
+	})
+	select {
+	case r := <-ch:
+		if r.Shared {
+			stats.coalesced.Add(1)
+		}
+		return r.Val.(cnameResult), r.Err
+	case <-ctx.Done():
+		return cnameResult{rcode: -1}, ctx.Err()
+	}
+}
+
+// lookupCNAME does the work of getCNAME for one caller.
+func lookupCNAME(ctx context.Context, domain, server, network string) (cnameResult, error) {
+	res, err := queryCNAME(ctx, domain, server, network)
+	if config.confirmEmpty && errors.Is(err, errEmptyAnswer) {
+		if other := resolvers.pickOther(server); other != "" {
+			return queryCNAME(bypassCache(ctx), domain, other, network)
+		}
+	}
+	return res, err
+}
+
+// queryCNAME looks up the CNAME for domain against server using the given
+// dns.Client network; "udp", "tcp" or "tcp-tls" (DNS over TLS). A server
+// that's a DNS over HTTPS endpoint is queried over that instead.
+//
+// With config.queryAuto it asks for the A record instead; a recursive
+// resolver then follows the CNAME itself and the answer says both what the
+// CNAME is and whether its target resolves, in a single round trip.
+func queryCNAME(ctx context.Context, domain, server, network string) (cnameResult, error) {
+	return queryCNAMEFrom(ctx, domain, server, network, nil)
+}
+
+// queryCNAMEFrom is queryCNAME, sending subnet as the EDNS client subnet
+// when it's non-nil so that resolvers which honor ECS answer as they would
+// for a client in that network.
+func queryCNAMEFrom(ctx context.Context, domain, server, network string, subnet *net.IPNet) (cnameResult, error) {
+	qtype := config.qtype
+	if config.queryAuto {
+		qtype = dns.TypeA
+	}
+	return queryRecords(ctx, domain, server, network, qtype, subnet)
+}
+
+// queryRecords does the work of queryCNAMEFrom for any query type. For
+// types other than CNAME and A the names the answer points at are in the
+// result's targets.
+func queryRecords(ctx context.Context, domain, server, network string, qtype uint16, subnet *net.IPNet) (cnameResult, error) {
+	c, address := dial(server, network)
+
+	m := dns.Msg{}
+	if domain[len(domain)-1:] != "." {
+		domain += "."
+	}
+	m.SetQuestion(domain, qtype)
+	m.RecursionDesired = !config.noRecursion && !isAuthoritativeServer(server)
+	// the NSID logged below has to be the one of the server asked, not of
+	// whichever resolver a cached answer came from
+	if config.nsid {
+		ctx = bypassCache(ctx)
+	}
+	// resolvers only send Extended DNS Errors, which
+	// -throttle-on-rate-limit looks for, in answer to EDNS0 queries
+	if config.ednsBufferSize > 0 || config.nsid || subnet != nil || config.throttleOnRateLimit {
+		// without -edns-buffer-size the options still need EDNS0, but
+		// there's no reason to advertise more than plain DNS allows
+		size := uint16(config.ednsBufferSize)
+		if size == 0 {
+			size = dns.MinMsgSize
+		}
+		m.SetEdns0(size, false)
+		opt := m.IsEdns0()
+		if config.nsid {
+			opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+		}
+		if subnet != nil {
+			opt.Option = append(opt.Option, clientSubnet(subnet))
+		}
+	}
+
+	r, _, err := c.Exchange(ctx, &m, address)
+	if err != nil {
+		return cnameResult{rcode: -1}, err
+	}
+	slog.Debug("response", "domain", domain, "resolver", server, "rcode", dns.RcodeToString[r.Rcode])
+
+	// without recursion a server that doesn't have the answer refers us to
+	// nameservers closer to it instead; each of them is asked in turn, never
+	// from the cache, since the question stays the same
+	for hops := 0; !m.RecursionDesired && isReferral(r) && hops < maxReferrals; hops++ {
+		next := referral(ctx, r)
+		if next == "" {
+			break
+		}
+		slog.Debug("following referral", "domain", domain, "from", server, "to", next)
+
+		server = next
+		c, address = dial(server, network)
+		r, _, err = c.Exchange(bypassCache(ctx), &m, address)
+		if err != nil {
+			return cnameResult{rcode: -1}, err
+		}
+	}
+
+	// a truncated UDP response may be missing records; TCP has room for
+	// all of them
+	if r.Truncated && network == "udp" && !isDoH(server) {
+		c, address = dial(server, "tcp")
+		tr, _, err := c.Exchange(ctx, &m, address)
+		if err != nil {
+			return cnameResult{rcode: -1}, err
+		}
+		r = tr
+	}
+
+	if config.nsid {
+		if id := nsid(r); id != "" {
+			slog.Info("nsid", "resolver", server, "nsid", id, "domain", domain)
+		}
+	}
+
+	res := cnameResult{rcode: r.Rcode}
+	if qtype == dns.TypeCNAME || qtype == dns.TypeA {
+		var ttl uint32
+		if res.target, ttl = answerCNAME(r, domain); res.target != "" {
+			res.ttl = &ttl
+		}
+	} else if res.targets = answerTargets(r, domain); len(res.targets) > 0 {
+		res.target = res.targets[0].name
+	}
+
+	if res.target != "" {
+		if qtype == dns.TypeA {
+			res.resolution = inlineResolution(r)
+			// the answer already holds the rest of the chain, so there's
+			// no need to query for each link of it again
+			if chain := answerChain(r, domain); len(chain) > 1 {
+				res.target = chain[len(chain)-1]
+				res.chain = chain
+			}
+		}
+		return res, nil
+	}
+
+	if r.Truncated {
+		return res, fmt.Errorf("%w for %s", errTruncated, domain)
+	}
+	switch r.Rcode {
+	case dns.RcodeSuccess:
+		if len(r.Answer) == 0 && len(r.Ns) == 0 {
+			return res, fmt.Errorf("%w for %s", errEmptyAnswer, domain)
+		}
+	case dns.RcodeNameError:
+		return res, fmt.Errorf("%w for %s", errNXDomain, domain)
+	case dns.RcodeServerFailure:
+		return res, fmt.Errorf("%w for %s", errServfail, domain)
+	case dns.RcodeRefused:
+		return res, fmt.Errorf("%w for %s", errRefused, domain)
+	default:
+		return res, fmt.Errorf("%s for %s", dns.RcodeToString[r.Rcode], domain)
+	}
+	return res, fmt.Errorf("%w for %s", errNoCNAME, domain)
+
+}
+
+// maxReferrals is the most referrals followed for a single query with
+// -no-recursion.
+const maxReferrals = 8
+
+// isReferral reports whether r hands the question on to other nameservers
+// rather than answering it.
+func isReferral(r *dns.Msg) bool {
+	if r.Rcode != dns.RcodeSuccess || r.Authoritative || len(r.Answer) > 0 {
+		return false
+	}
+	for _, rr := range r.Ns {
+		if _, ok := rr.(*dns.NS); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// referral returns the address of one of the nameservers the referral r
+// points at, preferring the glue records in it over looking them up.
+func referral(ctx context.Context, r *dns.Msg) string {
+	var ns []string
+	for _, rr := range r.Ns {
+		if n, ok := rr.(*dns.NS); ok {
+			ns = append(ns, n.Ns)
+		}
+	}
+	for _, rr := range r.Extra {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			continue
+		}
+		for _, n := range ns {
+			if strings.EqualFold(a.Hdr.Name, n) {
+				return a.A.String()
+			}
+		}
+	}
+	if addrs := nameserverAddrs(ctx, ns); len(addrs) > 0 {
+		return addrs[0]
+	}
+	return ""
+}
+
+// answerCNAME returns the target and TTL of the CNAME for domain in r, or
+// failing that of any CNAME in r.
+func answerCNAME(r *dns.Msg, domain string) (string, uint32) {
+	for _, ans := range r.Answer {
+		if cname, ok := ans.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, domain) {
+			return cname.Target, cname.Hdr.Ttl
+		}
+	}
+	for _, ans := range r.Answer {
+		if cname, ok := ans.(*dns.CNAME); ok {
+			return cname.Target, cname.Hdr.Ttl
+		}
+	}
+	return "", 0
+}
+
+// answerTargets returns the names pointed at by domain's records in r that
+// point at a name.
+func answerTargets(r *dns.Msg, domain string) []recordTarget {
+	var targets []recordTarget
+	for _, ans := range r.Answer {
+		if !strings.EqualFold(ans.Header().Name, domain) {
+			continue
+		}
+		switch rr := ans.(type) {
+		case *dns.CNAME:
+			targets = append(targets, recordTarget{rr.Target, dns.TypeCNAME})
+		case *dns.NS:
+			targets = append(targets, recordTarget{rr.Ns, dns.TypeNS})
+		// a target of "." says there's deliberately nothing there
+		case *dns.MX:
+			if rr.Mx != "." {
+				targets = append(targets, recordTarget{rr.Mx, dns.TypeMX})
+			}
+		case *dns.SRV:
+			if rr.Target != "." {
+				targets = append(targets, recordTarget{rr.Target, dns.TypeSRV})
+			}
+		}
+	}
+	return targets
+}
+
+func clientSubnet(subnet *net.IPNet) *dns.EDNS0_SUBNET {
+	ones, _ := subnet.Mask.Size()
+	e := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		SourceNetmask: uint8(ones),
+		Address:       subnet.IP,
+	}
+	if ip4 := subnet.IP.To4(); ip4 != nil {
+		e.Family = 1
+		e.Address = ip4
+	} else {
+		e.Family = 2
+	}
+	return e
+}
+
+// inlineResolution works out from the response to an A query whose answer
+// contained a CNAME whether the CNAME target resolves. A NOERROR response
+// without any addresses doesn't say whether the target has AAAA records, so
+// that's left for a separate lookup.
+func inlineResolution(r *dns.Msg) resolution {
+	for _, ans := range r.Answer {
+		if _, ok := ans.(*dns.A); ok {
+			return resolutionResolves
+		}
+	}
+	if r.Rcode == dns.RcodeNameError {
+		return resolutionDangling
+	}
+	return resolutionUnknown
+}
+
+// nsid returns the server identifier from the NSID option in r, if any.
+// Printable identifiers are returned as-is, anything else as hex.
+func nsid(r *dns.Msg) string {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+
+	for _, o := range opt.Option {
+		n, ok := o.(*dns.EDNS0_NSID)
+		if !ok {
+			continue
+		}
+
+		b, err := hex.DecodeString(n.Nsid)
+		if err != nil {
+			return n.Nsid
+		}
+		for _, c := range b {
+			if c < 0x20 || c > 0x7e {
+				return n.Nsid
+			}
+		}
+		return string(b)
+	}
+	return ""
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// blockingResolver is a hostResolver whose lookups never get an answer and
+// only return once ctx is done.
+type blockingResolver struct {
+	started chan struct{}
+}
+
+func (b blockingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	close(b.started)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (b blockingResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	close(b.started)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// cannedResolver is a hostResolver that knows the addresses of a fixed set
+// of names and nothing else. Names given as failing fail with a SERVFAIL.
+type cannedResolver map[string][]string
+
+// failing stands in for the addresses of a name whose lookups fail.
+var failing = []string{"fail"}
+
+func (c cannedResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	addrs, ok := c[host]
+	if slices.Equal(addrs, failing) {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: host, IsTemporary: true}
+	}
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func (c cannedResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	addrs, err := c.LookupHost(ctx, host)
+	var ips []net.IP
+	for _, a := range addrs {
+		ips = append(ips, net.ParseIP(a))
+	}
+	return ips, err
+}
+
+// useResolver swaps systemResolver for r until the test ends.
+func useResolver(t *testing.T, r hostResolver) {
+	t.Helper()
+	saved, savedCache, savedTimeout := systemResolver, responseCache, config.resolveTimeout
+	systemResolver, responseCache, config.resolveTimeout = r, nil, time.Hour
+	t.Cleanup(func() {
+		systemResolver, responseCache, config.resolveTimeout = saved, savedCache, savedTimeout
+	})
+}
+
+// countingResolver counts the lookups made through it.
+type countingResolver struct {
+	hostResolver
+	lookups *atomic.Int32
+}
+
+func (c countingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	c.lookups.Add(1)
+	return c.hostResolver.LookupHost(ctx, host)
+}
+
+func TestResolves(t *testing.T) {
+	var lookups atomic.Int32
+	useResolver(t, countingResolver{cannedResolver{
+		"v4.example.com":   {"192.0.2.1"},
+		"both.example.com": {"192.0.2.1", "2001:db8::1"},
+		"fail.example.com": failing,
+	}, &lookups})
+	responseCache = newMemoryCache()
+
+	for _, tt := range []struct {
+		name       string
+		want       families
+		wantErr    bool
+		remembered bool
+	}{
+		{"v4.example.com", familyIPv4, false, true},
+		{"both.example.com", familyIPv4 | familyIPv6, false, true},
+		{"gone.example.com", 0, true, true},
+		{"fail.example.com", 0, true, false},
+	} {
+		for i := range 2 {
+			before := lookups.Load()
+			addrs, err := resolves(context.Background(), tt.name)
+			if got := familiesOf(addrs); got != tt.want {
+				t.Errorf("%s: resolves to %v, want %v", tt.name, got, tt.want)
+			}
+			// what's remembered is remembered without the error
+			if i == 0 && (err != nil) != tt.wantErr {
+				t.Errorf("%s: err %v, want error %v", tt.name, err, tt.wantErr)
+			}
+			looked := lookups.Load() > before
+			if i == 1 && looked == tt.remembered {
+				t.Errorf("%s: looked up again %v, want %v", tt.name, looked, !tt.remembered)
+			}
+		}
+	}
+}
+
+func TestCheckServiceRanges(t *testing.T) {
+	for _, tt := range []struct {
+		addrs []string
+		want  string
+	}{
+		{[]string{"2001:db8::1", "185.199.109.153"}, "GitHub Pages"},
+		{[]string{"192.0.2.1"}, ""},
+		{nil, ""},
+	} {
+		if got := checkServiceRanges(tt.addrs); got != tt.want {
+			t.Errorf("checkServiceRanges(%v) = %q, want %q", tt.addrs, got, tt.want)
+		}
+	}
+}
+
+func TestResolvesCancelled(t *testing.T) {
+	fake := blockingResolver{started: make(chan struct{})}
+	useResolver(t, fake)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-fake.started
+		cancel()
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		addrs, err := resolves(ctx, "slow.example.com")
+		if familiesOf(addrs).resolves() {
+			t.Errorf("cancelled lookup resolves to %v", addrs)
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("resolves: got %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("resolves didn't return after ctx was cancelled")
+	}
+}
+
+func TestResolvesAlreadyCancelled(t *testing.T) {
+	fake := blockingResolver{started: make(chan struct{})}
+	useResolver(t, fake)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := resolves(ctx, "slow.example.com"); !errors.Is(err, context.Canceled) {
+		t.Errorf("resolves: got %v, want %v", err, context.Canceled)
+	}
+	select {
+	case <-fake.started:
+		t.Error("lookup made after ctx was cancelled")
+	default:
+	}
+}
+
+// TestDoHTimeout checks that a DoH query gives up after -t like a plain one.
+func TestDoHTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	saved := config.timeout
+	config.timeout = 50 * time.Millisecond
+	defer func() { config.timeout = saved }()
+
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeCNAME)
+	start := time.Now()
+	if _, _, err := doh.Exchange(context.Background(), m, srv.URL); err == nil {
+		t.Fatal("query to an endpoint that never answers succeeded")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("gave up after %v, want about %v", took, config.timeout)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohMediaType is the content type of DNS over HTTPS messages (RFC 8484).
+const dohMediaType = "application/dns-message"
+
+// dohExchanger sends queries over DNS over HTTPS, with the address passed
+// to Exchange being the URL of the endpoint. Each query gets config.timeout,
+// as it would over plain DNS.
+type dohExchanger struct {
+	client *http.Client
+}
+
+var doh = dohExchanger{client: &http.Client{}}
+
+func (d dohExchanger) Exchange(ctx context.Context, m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	if config.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.timeout)
+		defer cancel()
+	}
+
+	// RFC 8484 asks for an ID of 0 so that responses can be cached
+	q := m.Copy()
+	q.Id = 0
+	wire, err := q.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, address, bytes.NewReader(wire))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+
+	start := time.Now()
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	rtt := time.Since(start)
+	if err != nil {
+		return nil, rtt, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, rtt, fmt.Errorf("%s: %s", address, resp.Status)
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, rtt, err
+	}
+	r.Id = m.Id
+	return r, rtt, nil
+}
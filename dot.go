@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// cnameGraph collects CNAME links for writing out as a Graphviz DOT graph.
+// Like targetIndex it's only used by the printer.
+type cnameGraph struct {
+	edges  map[[2]string]bool
+	status map[string]string
+}
+
+func newCNAMEGraph() *cnameGraph {
+	return &cnameGraph{
+		edges:  make(map[[2]string]bool),
+		status: make(map[string]string),
+	}
+}
+
+func (g *cnameGraph) add(r Result) {
+	switch r.Status {
+	case statusOK, statusDangling, statusNeedsConfirmation, statusTakeover, statusService:
+	default:
+		return
+	}
+
+	// with a chain every link gets an edge; the last one is r.CNAME
+	path := []string{r.Domain}
+	if len(r.Chain) > 1 {
+		path = append(path, r.Chain[:len(r.Chain)-1]...)
+	}
+	path = append(path, r.CNAME)
+
+	for i := 0; i < len(path)-1; i++ {
+		g.edges[[2]string{path[i], path[i+1]}] = true
+		if _, ok := g.status[path[i]]; !ok {
+			g.status[path[i]] = ""
+		}
+	}
+	g.status[r.CNAME] = r.Status
+}
+
+var dotColors = map[string]string{
+	statusOK:                "darkgreen",
+	statusService:           "blue",
+	statusDangling:          "orange",
+	statusNeedsConfirmation: "gold",
+	statusTakeover:          "red",
+}
+
+func (g *cnameGraph) write(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "digraph cnames {")
+	fmt.Fprintln(w, "\trankdir=LR;")
+
+	nodes := make([]string, 0, len(g.status))
+	for n := range g.status {
+		nodes = append(nodes, n)
+	}
+	sort.Strings(nodes)
+	for _, n := range nodes {
+		if c, ok := dotColors[g.status[n]]; ok {
+			fmt.Fprintf(w, "\t%q [color=%s];\n", n, c)
+		} else {
+			fmt.Fprintf(w, "\t%q;\n", n)
+		}
+	}
+
+	edges := make([][2]string, 0, len(g.edges))
+	for e := range g.edges {
+		edges = append(edges, e)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i][0] != edges[j][0] {
+			return edges[i][0] < edges[j][0]
+		}
+		return edges[i][1] < edges[j][1]
+	})
+	for _, e := range edges {
+		fmt.Fprintf(w, "\t%q -> %q;\n", e[0], e[1])
+	}
+
+	fmt.Fprintln(w, "}")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
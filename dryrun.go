@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// hostnameLabel is a single label of a hostname. Underscores are allowed
+// for names like _dmarc.example.com that can have CNAMEs too.
+var hostnameLabel = regexp.MustCompile(`^[a-z0-9_]([a-z0-9_-]{0,61}[a-z0-9_])?$`)
+
+// validDomain reports whether domain is a well-formed hostname.
+func validDomain(domain string) bool {
+	domain = strings.TrimSuffix(domain, ".")
+	if _, ok := dns.IsDomainName(domain); !ok || domain == "" || len(domain) > 253 {
+		return false
+	}
+	for _, l := range strings.Split(domain, ".") {
+		if !hostnameLabel.MatchString(l) {
+			return false
+		}
+	}
+	return true
+}
+
+// dryRun reads every line the way a run would and counts the valid and
+// invalid domains among them, logging each invalid one, then writes the
+// counts and the settings a run would use to w.
+func dryRun(w io.Writer, lines <-chan string) (valid, invalid int) {
+	for line := range lines {
+		domain, _, _, err := parseLine(line)
+		switch {
+		case err != nil:
+			slog.Warn("invalid line", "line", line, "err", err)
+			invalid++
+		case domain == "":
+		case !validDomain(domain):
+			slog.Warn("invalid domain", "domain", domain)
+			invalid++
+		default:
+			valid++
+		}
+	}
+
+	domainTimeout := "none"
+	if config.domainTimeout > 0 {
+		domainTimeout = config.domainTimeout.String()
+	}
+	fmt.Fprintf(w, "resolvers: %s\n", strings.Join(config.resolvers, ", "))
+	fmt.Fprintf(w, "concurrency: %d\n", config.concurrency)
+	fmt.Fprintf(w, "timeout: %s per query, %s per address lookup, %s per domain\n", config.timeout, config.resolveTimeout, domainTimeout)
+	fmt.Fprintf(w, "query type: %s\n", dns.TypeToString[config.qtype])
+	fmt.Fprintf(w, "domains: %d valid, %d invalid\n", valid, invalid)
+	return valid, invalid
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/garmir/check-cnames/checkcname"
+	"gopkg.in/yaml.v3"
+)
+
+// subjackFingerprint is an entry in a subjack-style fingerprints.json.
+// Depending on the version of the list, fingerprint is either a single
+// string or a list of them.
+type subjackFingerprint struct {
+	Service     string          `json:"service"`
+	CNAME       []string        `json:"cname"`
+	Ranges      []string        `json:"ranges"`
+	Fingerprint json.RawMessage `json:"fingerprint"`
+	NXDomain    bool            `json:"nxdomain"`
+}
+
+// signature is an entry in the native signature format, a JSON or YAML
+// list. Pattern, ranges and fingerprint can each be a single string or a
+// list. Ranges are CIDR prefixes the service's addresses are in, for
+// -match-ranges. Method, path and host are those of the request the
+// fingerprint is looked for in, as in httpProbe.
+type signature struct {
+	Service     string     `yaml:"service"`
+	Pattern     stringList `yaml:"pattern"`
+	Ranges      stringList `yaml:"ranges"`
+	Fingerprint stringList `yaml:"fingerprint"`
+	Method      string     `yaml:"method"`
+	Path        string     `yaml:"path"`
+	Host        string     `yaml:"host"`
+	Detection   string     `yaml:"detection"`
+	Confidence  string     `yaml:"confidence"`
+}
+
+// stringList is a YAML value that's either a single string or a list.
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		*l = stringList{n.Value}
+		return nil
+	}
+	var list []string
+	if err := n.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// loadFingerprints reads services from path. The format is detected from
+// the contents; subjack's fingerprints.json, or the native signature format
+// otherwise.
+func loadFingerprints(path string) ([]service, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if isSubjack(b) {
+		return parseSubjack(b)
+	}
+	services, err := parseNative(b)
+	if err != nil {
+		return nil, fmt.Errorf("unrecognised fingerprint format in %s: %w", path, err)
+	}
+	return services, nil
+}
+
+// parseNative translates native signatures, JSON or YAML, into services.
+func parseNative(b []byte) ([]service, error) {
+	var entries []signature
+	if err := yaml.Unmarshal(b, &entries); err != nil {
+		return nil, err
+	}
+
+	services := make([]service, 0, len(entries))
+	for _, e := range entries {
+		if e.Service == "" || len(e.Pattern) == 0 {
+			return nil, fmt.Errorf("signature without a service and pattern")
+		}
+		s := service{Name: e.Service}
+		for _, p := range e.Pattern {
+			// patterns match whole labels, so ".foo.example" and
+			// "foo.example" mean the same
+			s.Patterns = append(s.Patterns, strings.Trim(strings.ToLower(p), "."))
+		}
+		ranges, err := parseRanges(e.Ranges)
+		if err != nil {
+			return nil, fmt.Errorf("signature for %s: %w", e.Service, err)
+		}
+		s.Ranges = ranges
+		if len(e.Fingerprint) > 0 {
+			s.Probe = &httpProbe{
+				Method:     strings.ToUpper(e.Method),
+				Path:       e.Path,
+				Host:       e.Host,
+				Signatures: e.Fingerprint,
+			}
+		} else if e.Method != "" || e.Path != "" || e.Host != "" {
+			return nil, fmt.Errorf("signature for %s: method, path and host need a fingerprint", e.Service)
+		}
+		if e.Path != "" && !strings.HasPrefix(e.Path, "/") {
+			return nil, fmt.Errorf("signature for %s: path %q doesn't start with /", e.Service, e.Path)
+		}
+		d, err := checkcname.ParseDetection(e.Detection)
+		if err != nil {
+			return nil, fmt.Errorf("signature for %s: %w", e.Service, err)
+		}
+		if d == checkcname.DetectHTTP && s.Probe == nil {
+			return nil, fmt.Errorf("signature for %s: http detection needs a fingerprint", e.Service)
+		}
+		s.Detection = d
+		if s.Confidence, err = checkcname.ParseConfidence(e.Confidence); err != nil {
+			return nil, fmt.Errorf("signature for %s: %w", e.Service, err)
+		}
+		services = append(services, s)
+	}
+	return services, nil
+}
+
+func isSubjack(b []byte) bool {
+	var entries []map[string]json.RawMessage
+	if err := json.Unmarshal(b, &entries); err != nil || len(entries) == 0 {
+		return false
+	}
+	_, hasService := entries[0]["service"]
+	_, hasCNAME := entries[0]["cname"]
+	return hasService && hasCNAME
+}
+
+// parseSubjack translates subjack entries into services. Entries marked
+// nxdomain are vulnerable when their target doesn't resolve at all, so they
+// get no HTTP probe; the dangling check is all the confirmation there is.
+// The rest are recognised by their fingerprint.
+func parseSubjack(b []byte) ([]service, error) {
+	var entries []subjackFingerprint
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, err
+	}
+
+	services := make([]service, 0, len(entries))
+	for _, e := range entries {
+		if e.Service == "" || len(e.CNAME) == 0 {
+			continue
+		}
+		s := service{Name: e.Service}
+		for _, p := range e.CNAME {
+			s.Patterns = append(s.Patterns, strings.Trim(strings.ToLower(p), "."))
+		}
+
+		ranges, err := parseRanges(e.Ranges)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ranges for %s: %w", e.Service, err)
+		}
+		s.Ranges = ranges
+		sigs, err := parseSignatures(e.Fingerprint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fingerprint for %s: %w", e.Service, err)
+		}
+		if !e.NXDomain && len(sigs) > 0 {
+			s.Probe = &httpProbe{Signatures: sigs}
+			s.Detection = checkcname.DetectHTTP
+		}
+		services = append(services, s)
+	}
+	return services, nil
+}
+
+// parseRanges parses CIDR prefixes such as 192.0.2.0/24 or 2001:db8::/32.
+func parseRanges(list []string) ([]*net.IPNet, error) {
+	var ranges []*net.IPNet
+	for _, r := range list {
+		p, err := netip.ParsePrefix(strings.TrimSpace(r))
+		if err != nil {
+			return nil, err
+		}
+		p = p.Masked()
+		ranges = append(ranges, &net.IPNet{
+			IP:   p.Addr().AsSlice(),
+			Mask: net.CIDRMask(p.Bits(), p.Addr().BitLen()),
+		})
+	}
+	return ranges, nil
+}
+
+func parseSignatures(raw json.RawMessage) ([]string, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil, nil
+	}
+
+	if raw[0] == '"' {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, err
+		}
+		if s == "" {
+			return nil, nil
+		}
+		return []string{s}, nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, err
+	}
+
+	sigs := list[:0]
+	for _, s := range list {
+		if s != "" {
+			sigs = append(sigs, s)
+		}
+	}
+	return sigs, nil
+}
+
+// addServices puts loaded services ahead of the built-in ones, replacing
+// any built-in service of the same name, or all of them with
+// config.replaceSignatures.
+func addServices(loaded []service) {
+	if config.replaceSignatures {
+		vulnerableServices = loaded
+		return
+	}
+
+	names := make(map[string]bool, len(loaded))
+	for _, s := range loaded {
+		names[s.Name] = true
+	}
+
+	merged := loaded
+	for _, s := range vulnerableServices {
+		if !names[s.Name] {
+			merged = append(merged, s)
+		}
+	}
+	vulnerableServices = merged
+}
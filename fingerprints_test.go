@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/garmir/check-cnames/checkcname"
+)
+
+func TestParseNativeProbe(t *testing.T) {
+	for _, format := range []string{
+		`
+- service: Example
+  pattern: .Example.net.
+  fingerprint: no such site
+  method: head
+  path: /status
+  host: probe.example.net
+  detection: http
+`,
+		`[{"service": "Example", "pattern": [".Example.net."], "fingerprint": ["no such site"],
+  "method": "head", "path": "/status", "host": "probe.example.net", "detection": "http"}]`,
+	} {
+		services, err := parseNative([]byte(format))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(services) != 1 {
+			t.Fatalf("got %d services, want 1", len(services))
+		}
+		s := services[0]
+		if len(s.Patterns) != 1 || s.Patterns[0] != "example.net" {
+			t.Errorf("patterns %q, want [example.net]", s.Patterns)
+		}
+		if s.Detects() != checkcname.DetectHTTP {
+			t.Errorf("detection %q, want http", s.Detects())
+		}
+		want := httpProbe{Method: "HEAD", Path: "/status", Host: "probe.example.net", Signatures: []string{"no such site"}}
+		if s.Probe == nil || s.Probe.Method != want.Method || s.Probe.Path != want.Path || s.Probe.Host != want.Host ||
+			len(s.Probe.Signatures) != 1 || s.Probe.Signatures[0] != want.Signatures[0] {
+			t.Errorf("probe %+v, want %+v", s.Probe, want)
+		}
+	}
+}
+
+func TestParseNativeInvalid(t *testing.T) {
+	for _, sig := range []string{
+		`[{"service": "Example"}]`,
+		`[{"pattern": "example.net"}]`,
+		`[{"service": "Example", "pattern": "example.net", "detection": "http"}]`,
+		`[{"service": "Example", "pattern": "example.net", "path": "/status"}]`,
+		`[{"service": "Example", "pattern": "example.net", "fingerprint": "gone", "path": "status"}]`,
+		`[{"service": "Example", "pattern": "example.net", "detection": "maybe"}]`,
+		`[{"service": "Example", "pattern": "example.net", "ranges": "192.0.2.1"}]`,
+	} {
+		if _, err := parseNative([]byte(sig)); err == nil {
+			t.Errorf("parseNative(%s) succeeded", sig)
+		}
+	}
+}
+
+func TestParseSubjack(t *testing.T) {
+	services, err := parseSubjack([]byte(`[
+		{"service": "Example", "cname": [".Example.NET.", "example.org"], "fingerprint": ["no such site", ""], "nxdomain": false},
+		{"service": "Gone", "cname": ["gone.example.net"], "fingerprint": "", "nxdomain": true},
+		{"service": "", "cname": ["skipped.example.net"]}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 {
+		t.Fatalf("got %d services, want 2", len(services))
+	}
+
+	s := services[0]
+	if len(s.Patterns) != 2 || s.Patterns[0] != "example.net" || s.Patterns[1] != "example.org" {
+		t.Errorf("patterns %q, want [example.net example.org]", s.Patterns)
+	}
+	if s.Detects() != checkcname.DetectHTTP || s.Probe == nil || len(s.Probe.Signatures) != 1 {
+		t.Errorf("got detection %q and probe %+v, want http with one signature", s.Detects(), s.Probe)
+	}
+	if got := checkcname.MatchService(services, "bucket.example.net"); got != "Example" {
+		t.Errorf("bucket.example.net matched %q, want Example", got)
+	}
+	if s := services[1]; s.Detects() != checkcname.DetectNXDomain || s.Probe != nil {
+		t.Errorf("nxdomain entry: got detection %q and probe %+v", s.Detects(), s.Probe)
+	}
+}
+
+func TestParseRanges(t *testing.T) {
+	native, err := parseNative([]byte(`
+- service: Example
+  pattern: example.net
+  ranges: [192.0.2.0/24, "2001:db8::/32"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subjack, err := parseSubjack([]byte(`[{"service": "Example", "cname": ["example.net"], "ranges": ["192.0.2.7/24", "2001:db8::/32"]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := vulnerableServices
+	defer func() { vulnerableServices = saved }()
+	for format, services := range map[string][]service{"native": native, "subjack": subjack} {
+		vulnerableServices = services
+		for _, tt := range []struct {
+			addr string
+			want string
+		}{
+			{"192.0.2.10", "Example"},
+			{"2001:db8::10", "Example"},
+			{"198.51.100.1", ""},
+		} {
+			if got := checkServiceRanges([]string{tt.addr}); got != tt.want {
+				t.Errorf("%s: %s matched %q, want %q", format, tt.addr, got, tt.want)
+			}
+		}
+	}
+
+	if _, err := parseSubjack([]byte(`[{"service": "Example", "cname": ["example.net"], "ranges": ["example"]}]`)); err == nil {
+		t.Error("parseSubjack accepted an invalid range")
+	}
+}
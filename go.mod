@@ -0,0 +1,18 @@
+module github.com/garmir/check-cnames
+
+go 1.25.0
+
+require (
+	github.com/miekg/dns v1.1.73
+	github.com/redis/go-redis/v9 v9.22.0
+	golang.org/x/net v0.57.0
+	golang.org/x/sync v0.22.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	go.uber.org/atomic v1.11.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+)
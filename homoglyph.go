@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// confusables maps characters that are easily mistaken for an ASCII letter
+// onto that letter. It's a small subset of the Unicode confusables data,
+// covering the Cyrillic and Greek lookalikes seen in spoofed domains.
+var confusables = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'һ': 'h', 'і': 'i', 'ј': 'j', 'к': 'k',
+	'о': 'o', 'р': 'p', 'ԛ': 'q', 'с': 'c', 'ѕ': 's', 'т': 't', 'у': 'y',
+	'х': 'x', 'ԁ': 'd', 'ԝ': 'w', 'ӏ': 'l', 'ь': 'b', 'п': 'n', 'г': 'r',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v',
+	'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x', 'ω': 'w',
+	// Latin lookalikes
+	'ɑ': 'a', 'ɡ': 'g', 'ı': 'i', 'ɩ': 'i', 'ł': 'l', 'ɭ': 'l', 'ɴ': 'n',
+	'ʀ': 'r', 'ѵ': 'v', 'ẏ': 'y', 'ż': 'z', 'ḃ': 'b', 'ċ': 'c', 'ḋ': 'd',
+	'ė': 'e', 'ġ': 'g', 'ḣ': 'h', 'ṁ': 'm', 'ṅ': 'n', 'ȯ': 'o', 'ṗ': 'p',
+	'ṙ': 'r', 'ṡ': 's', 'ṫ': 't', 'ẇ': 'w', 'ẋ': 'x',
+}
+
+// brandDomains are domains worth impersonating in a CNAME target, on top
+// of every pattern of the known services.
+var brandDomains = []string{
+	"amazon.com",
+	"amazonaws.com",
+	"apple.com",
+	"akamaiedge.net",
+	"cloudflare.com",
+	"cloudflare.net",
+	"facebook.com",
+	"github.com",
+	"google.com",
+	"googleusercontent.com",
+	"microsoft.com",
+	"paypal.com",
+}
+
+// skeleton maps every confusable character in s onto the letter it looks
+// like.
+func skeleton(s string) string {
+	return strings.Map(func(r rune) rune {
+		if c, ok := confusables[r]; ok {
+			return c
+		}
+		return r
+	}, strings.ToLower(s))
+}
+
+// checkHomoglyph flags CNAME targets that, once decoded from punycode, only
+// look like they're under a well-known domain because they use confusable
+// characters.
+func checkHomoglyph(domain, cname, server string) (Result, bool) {
+	target := strings.ToLower(strings.TrimSuffix(cname, "."))
+	decoded, err := idna.ToUnicode(target)
+	if err != nil || decoded == target {
+		return Result{}, false
+	}
+
+	skel := skeleton(decoded)
+	for _, brand := range brands() {
+		if !hasDomainSuffix(skel, brand) || hasDomainSuffix(decoded, brand) {
+			continue
+		}
+
+		return Result{
+			Domain:   domain,
+			CNAME:    target,
+			Status:   statusHomoglyph,
+			Detail:   decoded + " looks like " + brand,
+			Resolver: server,
+		}, true
+	}
+	return Result{}, false
+}
+
+func brands() []string {
+	list := append([]string(nil), brandDomains...)
+	for _, s := range vulnerableServices {
+		list = append(list, s.Patterns...)
+	}
+	return list
+}
+
+func hasDomainSuffix(name, suffix string) bool {
+	return name == suffix || strings.HasSuffix(name, "."+suffix)
+}
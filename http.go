@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxProbeBody is how much of a probe response is searched for the
+// service's signature.
+const maxProbeBody = 1 << 20
+
+var httpClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		// takeover pages are usually served with a certificate for the
+		// provider rather than the domain
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// needsConfirmation reports whether any of rs is waiting to be confirmed
+// over HTTP.
+func needsConfirmation(rs []Result) bool {
+	for _, r := range rs {
+		if r.confirm {
+			return true
+		}
+	}
+	return false
+}
+
+// confirmResults runs verifyHTTP for the results checkTarget left waiting
+// for it. A probe cut short by ctx ending looks just like one that didn't
+// find the signature, so once it has, the rest are reported as DNS left
+// them, unconfirmed.
+func confirmResults(ctx context.Context, domain string, rs []Result) []Result {
+	for i := range rs {
+		r := &rs[i]
+		if !r.confirm {
+			continue
+		}
+		if ctx.Err() == nil {
+			unconfirmed := *r
+			done := startPhase(ctx, phaseConfirm)
+			verifyHTTP(ctx, r)
+			done()
+			if ctx.Err() != nil {
+				*r = unconfirmed
+				slog.Warn("HTTP confirmation cut short, reporting unconfirmed", "domain", domain, "err", ctx.Err())
+			}
+		}
+		if ctx.Err() != nil {
+			unconfirm(r)
+		}
+		r.confirm = false
+		// the service was only looked for to be confirmed
+		if r.guessed && r.Status != statusTakeover {
+			r.Service = ""
+		}
+	}
+	return rs
+}
+
+// unconfirm puts back the status a result waiting for confirmation had
+// before it was: a dangling target that only the fingerprint would show to
+// be unclaimed needs confirmation again.
+func unconfirm(r *Result) {
+	if r.Status == statusDangling && detectionOf(r.Service) == detectHTTP {
+		r.Status = statusNeedsConfirmation
+	}
+}
+
+// verifyHTTP probes r.Domain as described by its service and adjusts the
+// status to match: a takeover at a service recognised by its fingerprint is
+// downgraded to dangling if the signature isn't found, and a resolving CNAME
+// into a service is upgraded to a takeover if it is. A takeover found by its
+// target not resolving stands on its own; the domain can't be fetched then
+// anyway. Services without a probe are left alone.
+func verifyHTTP(ctx context.Context, r *Result) {
+	if r.Service == cloudFront {
+		verifyCloudFront(ctx, r)
+		return
+	}
+
+	s, ok := serviceByName(r.Service)
+	if !ok || s.Probe == nil {
+		return
+	}
+
+	if probeHTTP(ctx, r.Domain, s.Probe) {
+		r.Status = statusTakeover
+		r.fingerprinted = true
+		return
+	}
+	if r.Status == statusTakeover && detectionOf(r.Service) == detectHTTP {
+		r.Status = statusDangling
+	}
+}
+
+// verifyCloudFront tells apart the two ways a CNAME into CloudFront can be
+// taken over. If the distribution has been deleted its dXXXX.cloudfront.net
+// name no longer resolves at all. If it still exists but the domain has been
+// removed from its alternate domain names, CloudFront answers requests for
+// the domain with a 403 "Bad request" error page, and anyone can add the
+// domain to a distribution of their own. Anything else is a distribution
+// that's serving the domain and is left alone.
+func verifyCloudFront(ctx context.Context, r *Result) {
+	if r.Status == statusTakeover {
+		r.Detail = "distribution deleted"
+		return
+	}
+
+	resp, body, err := fetch(ctx, r.Domain, &httpProbe{})
+	if err != nil {
+		return
+	}
+	if resp.StatusCode == http.StatusForbidden &&
+		strings.Contains(resp.Header.Get("X-Cache"), "Error from cloudfront") &&
+		strings.Contains(string(body), "Bad request") {
+		r.Status = statusTakeover
+		r.Detail = "alias not configured"
+		r.fingerprinted = true
+	}
+}
+
+// probeHTTP reports whether the response to p for domain contains one of
+// p's signatures.
+func probeHTTP(ctx context.Context, domain string, p *httpProbe) bool {
+	_, body, err := fetch(ctx, domain, p)
+	if err != nil {
+		return false
+	}
+
+	for _, sig := range p.Signatures {
+		if strings.Contains(string(body), sig) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetch makes the request described by p to domain over HTTPS or, failing
+// that, HTTP. The returned response's body has already been read and
+// closed.
+func fetch(ctx context.Context, domain string, p *httpProbe) (*http.Response, []byte, error) {
+	method := p.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	path := p.Path
+	if path == "" {
+		path = "/"
+	}
+	host := p.Host
+	if host == "" {
+		host = domain
+	}
+
+	var lastErr error
+	for _, scheme := range []string{"https", "http"} {
+		req, err := http.NewRequestWithContext(ctx, method, scheme+"://"+domain+path, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Host = host
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxProbeBody))
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return resp, body, nil
+	}
+	return nil, nil, lastErr
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestProbeHTTPRequest(t *testing.T) {
+	var got *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Write([]byte("<h1>Help Center Closed</h1>"))
+	}))
+	defer srv.Close()
+	domain := strings.TrimPrefix(srv.URL, "http://")
+
+	p := &httpProbe{Method: http.MethodPost, Path: "/hc/en-us", Host: "probe.example.net", Signatures: []string{"Help Center Closed"}}
+	if !probeHTTP(context.Background(), domain, p) {
+		t.Error("signature not found")
+	}
+	if got == nil || got.Method != http.MethodPost || got.URL.Path != "/hc/en-us" || got.Host != "probe.example.net" {
+		t.Fatalf("got request %+v", got)
+	}
+
+	// without them it's a GET of / for the domain itself
+	if !probeHTTP(context.Background(), domain, &httpProbe{Signatures: []string{"Help Center Closed"}}) {
+		t.Error("signature not found")
+	}
+	if got.Method != http.MethodGet || got.URL.Path != "/" || got.Host != domain {
+		t.Errorf("got %s %s for %s, want GET / for %s", got.Method, got.URL.Path, got.Host, domain)
+	}
+
+	if probeHTTP(context.Background(), domain, &httpProbe{Signatures: []string{"There isn't a GitHub Pages site here"}}) {
+		t.Error("signature found in a page without it")
+	}
+}
+
+func TestCloudFrontAliasNotConfigured(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Cache", "Error from cloudfront")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("<H1>403 ERROR</H1><H2>The request could not be satisfied.</H2>Bad request."))
+	}))
+	defer srv.Close()
+	domain := strings.TrimPrefix(srv.URL, "http://")
+	res := cnameResult{target: "d111111abcdef8.cloudfront.net.", resolution: resolutionResolves}
+	defer func() { config.httpVerify = false }()
+
+	for _, verify := range []bool{false, true} {
+		config.httpVerify = verify
+		rs := []Result{checkTarget(context.Background(), domain, res, "192.0.2.53")}
+		if needsConfirmation(rs) {
+			rs = confirmResults(context.Background(), domain, rs)
+		}
+		r := rs[0]
+
+		want := Result{Status: statusOK}
+		if verify {
+			want = Result{Status: statusTakeover, Service: cloudFront, Detail: "alias not configured"}
+		}
+		if r.Status != want.Status || r.Service != want.Service || r.Detail != want.Detail {
+			t.Errorf("-http-verify=%v: got %s %q %q, want %s %q %q", verify, r.Status, r.Service, r.Detail, want.Status, want.Service, want.Detail)
+		}
+	}
+}
+
+// countingTransport fails every request, counting them.
+type countingTransport struct {
+	requests *int
+}
+
+func (c countingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	*c.requests++
+	return nil, errors.New("no network in tests")
+}
+
+// TestFingerprintNeedsHTTPVerify checks that nothing is fetched without
+// -http-verify, and that a dangling target at a service recognised by its
+// fingerprint then needs confirmation.
+func TestFingerprintNeedsHTTPVerify(t *testing.T) {
+	var requests int
+	saved := httpClient.Transport
+	httpClient.Transport = countingTransport{&requests}
+	defer func() { httpClient.Transport = saved }()
+
+	for _, verify := range []bool{false, true} {
+		useReplay(t,
+			replayed{name: "gone.example.com", qtype: dns.TypeCNAME, answer: []string{"gone.example.com. 60 IN CNAME gone.herokuapp.com."}},
+			replayed{name: "gone.herokuapp.com", qtype: dns.TypeA, rcode: dns.RcodeNameError},
+			replayed{name: "gone.herokuapp.com", qtype: dns.TypeAAAA, rcode: dns.RcodeNameError},
+			replayed{name: "live.example.com", qtype: dns.TypeCNAME, answer: []string{"live.example.com. 60 IN CNAME live.herokuapp.com."}},
+			replayed{name: "live.herokuapp.com", qtype: dns.TypeA, answer: []string{"live.herokuapp.com. 60 IN A 192.0.2.10"}},
+			replayed{name: "live.herokuapp.com", qtype: dns.TypeAAAA},
+		)
+		config.maxDepth = 1
+		config.httpVerify = verify
+		requests = 0
+
+		want := map[string]Result{
+			"gone.example.com": {Status: statusNeedsConfirmation, Service: "Heroku"},
+			"live.example.com": {Status: statusOK},
+		}
+		if verify {
+			// the probe fails, so there's no fingerprint
+			want["gone.example.com"] = Result{Status: statusDangling, Service: "Heroku"}
+		}
+		for domain, w := range want {
+			rs := processDomain(context.Background(), job{domain: domain, server: resolvers.pick()})
+			if needsConfirmation(rs) {
+				rs = confirmResults(context.Background(), domain, rs)
+			}
+			if len(rs) != 1 || rs[0].Status != w.Status || rs[0].Service != w.Service {
+				t.Errorf("-http-verify=%v: %s: got %+v, want %s %q", verify, domain, rs, w.Status, w.Service)
+			}
+		}
+		if verify && requests == 0 {
+			t.Error("-http-verify: nothing probed")
+		}
+		if !verify && requests > 0 {
+			t.Errorf("%d requests made without -http-verify", requests)
+		}
+	}
+}
+
+// TestHTTPVerifyKeepsNXDomainTakeover checks that a takeover found by its
+// target not resolving isn't downgraded when the probe, which can't reach
+// the domain, finds nothing.
+func TestHTTPVerifyKeepsNXDomainTakeover(t *testing.T) {
+	var requests int
+	saved := httpClient.Transport
+	httpClient.Transport = countingTransport{&requests}
+	defer func() { httpClient.Transport = saved }()
+
+	useReplay(t, danglingS3...)
+	config.httpVerify = true
+
+	rs := processDomain(context.Background(), job{domain: "a.example.com", server: resolvers.pick()})
+	if needsConfirmation(rs) {
+		rs = confirmResults(context.Background(), "a.example.com", rs)
+	}
+	if len(rs) != 1 || rs[0].Status != statusTakeover || rs[0].Service != "AWS S3" {
+		t.Errorf("got %+v, want a takeover on AWS S3", rs)
+	}
+}
+
+// TestConfirmResultsCutShort checks that results whose confirmation is cut
+// short are reported as DNS left them rather than dropped.
+func TestConfirmResultsCutShort(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	rs := confirmResults(ctx, "example.com", []Result{
+		{Domain: "example.com", Status: statusTakeover, Service: "AWS S3", confirm: true},
+		{Domain: "example.com", Status: statusDangling, Service: "Heroku", confirm: true},
+		{Domain: "example.com", Status: statusOK, Service: "GitHub Pages", confirm: true, guessed: true},
+	})
+	want := []Result{
+		{Status: statusTakeover, Service: "AWS S3"},
+		{Status: statusNeedsConfirmation, Service: "Heroku"},
+		{Status: statusOK},
+	}
+	if len(rs) != len(want) {
+		t.Fatalf("got %d results, want %d: %+v", len(rs), len(want), rs)
+	}
+	for i, w := range want {
+		if rs[i].Status != w.Status || rs[i].Service != w.Service || rs[i].confirm {
+			t.Errorf("result %d: got %s %q (confirm %v), want %s %q", i, rs[i].Status, rs[i].Service, rs[i].confirm, w.Status, w.Service)
+		}
+	}
+}
+
+// TestConfirmContext checks that confirming gets what the lookups left of
+// -domain-timeout, however long it waited for a worker.
+func TestConfirmContext(t *testing.T) {
+	saved := config.domainTimeout
+	config.domainTimeout = time.Minute
+	defer func() { config.domainTimeout = saved }()
+
+	ctx, cancel := confirmContext(pending{left: 20 * time.Second})
+	defer cancel()
+	dl, ok := ctx.Deadline()
+	if left := time.Until(dl); !ok || left > 20*time.Second || left < 19*time.Second {
+		t.Errorf("deadline in %v, want about 20s", left)
+	}
+
+	spent, cancel := confirmContext(pending{left: -time.Second})
+	defer cancel()
+	if spent.Err() == nil {
+		t.Error("context with none of -domain-timeout left isn't done")
+	}
+}
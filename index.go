@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+)
+
+// targetIndex maps each CNAME target to the input domains pointing at it,
+// answering which domains are affected if a given provider goes away.
+// It's only touched by the printer so needs no locking.
+type targetIndex map[string][]string
+
+func (idx targetIndex) add(r Result) {
+	switch r.Status {
+	case statusOK, statusDangling, statusNeedsConfirmation, statusTakeover, statusService:
+		idx[r.CNAME] = append(idx[r.CNAME], r.Domain)
+	}
+}
+
+// write stores the index as JSON in path, or on stdout if path is "-".
+func (idx targetIndex) write(path string) error {
+	for _, domains := range idx {
+		sort.Strings(domains)
+	}
+
+	out := os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(idx)
+}
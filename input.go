@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// followPoll is how often stdin is re-read after EOF when following a pipe.
+const followPoll = time.Second
+
+// input is a source of domains; path is "-" for stdin.
+type input struct {
+	path string
+	r    io.ReadCloser
+	fifo bool
+}
+
+// openInputs opens each of paths for reading, with "-" meaning stdin. No
+// paths at all means just stdin.
+func openInputs(paths []string) ([]*input, error) {
+	if len(paths) == 0 {
+		paths = []string{"-"}
+	}
+
+	var inputs []*input
+	for _, p := range paths {
+		in := &input{path: p}
+		var fi os.FileInfo
+		var err error
+		if p == "-" {
+			in.r = io.NopCloser(os.Stdin)
+			fi, err = os.Stdin.Stat()
+		} else {
+			var f *os.File
+			f, err = os.Open(p)
+			if err == nil {
+				in.r = f
+				fi, err = f.Stat()
+			}
+		}
+		if err != nil {
+			for _, in := range inputs {
+				in.r.Close()
+			}
+			return nil, err
+		}
+
+		in.fifo = fi.Mode()&os.ModeNamedPipe != 0
+		inputs = append(inputs, in)
+	}
+	return inputs, nil
+}
+
+// readLines reads every input concurrently, sending each line, or with
+// config.nulInput each NUL-separated entry, on the returned channel. The
+// channel is closed once all inputs are exhausted or stop is closed,
+// whichever comes first.
+//
+// With config.follow, EOF on a pipe isn't the end of it: a named pipe is
+// reopened to wait for the next writer and stdin is polled for more, so
+// the run only ends when stop is closed.
+func readLines(inputs []*input, stop <-chan struct{}) <-chan string {
+	raw := make(chan string)
+
+	var wg sync.WaitGroup
+	for _, in := range inputs {
+		wg.Add(1)
+		go func(in *input) {
+			defer wg.Done()
+			for {
+				sc := bufio.NewScanner(in.r)
+				if config.nulInput {
+					sc.Split(scanNUL)
+				}
+				for sc.Scan() {
+					raw <- sc.Text()
+				}
+				if err := sc.Err(); err != nil {
+					slog.Error("failed to read input", "err", err)
+				}
+
+				if !config.follow || !in.fifo || !in.reopen() {
+					in.r.Close()
+					return
+				}
+			}
+		}(in)
+	}
+
+	go func() {
+		wg.Wait()
+		close(raw)
+	}()
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		for {
+			select {
+			case l, ok := <-raw:
+				if !ok {
+					return
+				}
+				select {
+				case lines <- l:
+				case <-stop:
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return lines
+}
+
+// scanNUL is bufio.ScanLines for input separated by NUL bytes, as written
+// by find -print0. A final entry without a NUL after it still counts.
+func scanNUL(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// reopen gets the input ready to be read again after EOF, reporting false
+// if that's not possible.
+func (in *input) reopen() bool {
+	if in.path == "-" {
+		time.Sleep(followPoll)
+		return true
+	}
+
+	in.r.Close()
+	f, err := os.Open(in.path)
+	if err != nil {
+		slog.Error("failed to reopen input", "path", in.path, "err", err)
+		return false
+	}
+	in.r = f
+	return true
+}
+
+// parseLine splits an input line into the domain, lowercased and
+// punycode-encoded, the CNAME given with it under -cname-input and its tags.
+// With config.normalize the domain can also be given as a URL or a wildcard.
+// Blank lines have no domain.
+func parseLine(line string) (domain, cname string, tags map[string]string, err error) {
+	line, tags = splitTags(strings.TrimSpace(line))
+	if line == "" {
+		return "", "", nil, nil
+	}
+
+	if config.cnameInput {
+		var ok bool
+		line, cname, ok = strings.Cut(line, "\t")
+		if !ok {
+			return "", "", nil, errors.New("no CNAME")
+		}
+		if cname, err = toASCII(strings.TrimSpace(cname)); err != nil {
+			return "", "", nil, err
+		}
+	}
+	domain = strings.ToLower(strings.TrimSpace(line))
+	if config.normalize {
+		domain = normalizeInput(domain)
+	}
+	domain, err = toASCII(domain)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return domain, cname, tags, nil
+}
+
+// normalizeInput reduces a URL, or a host with a port or path, to just the
+// host, and strips a leading wildcard label.
+func normalizeInput(s string) string {
+	if strings.ContainsAny(s, ":/") {
+		raw := s
+		if !strings.Contains(raw, "://") {
+			raw = "//" + raw
+		}
+		if u, err := url.Parse(raw); err == nil && u.Hostname() != "" {
+			s = u.Hostname()
+		}
+	}
+	return strings.TrimPrefix(s, "*.")
+}
+
+// toASCII encodes any unicode labels in name as punycode. Only those go
+// through IDNA; ASCII labels are left as they are, since IDNA's hostname
+// rules would reject the underscores of _dmarc or _sip._tcp names and
+// labels like ab--cd that plenty of zones have.
+func toASCII(name string) (string, error) {
+	labels := strings.Split(name, ".")
+	for i, l := range labels {
+		if isASCII(l) {
+			continue
+		}
+		a, err := idna.Lookup.ToASCII(l)
+		if err != nil {
+			return "", fmt.Errorf("invalid internationalized name %q: %w", name, err)
+		}
+		labels[i] = a
+	}
+	return strings.Join(labels, "."), nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// toUnicode decodes any punycode labels in name for display, leaving names
+// that don't decode as they are.
+func toUnicode(name string) string {
+	if u, err := idna.ToUnicode(name); err == nil {
+		return u
+	}
+	return name
+}
+
+// readWordlist reads the subdomain labels in path, one per line.
+func readWordlist(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var words []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		w := strings.ToLower(strings.TrimSpace(sc.Text()))
+		if w == "" || strings.HasPrefix(w, "#") {
+			continue
+		}
+		words = append(words, strings.Trim(w, "."))
+	}
+	return words, sc.Err()
+}
+
+// expandWords turns each apex domain read from apexes into one name per
+// word, generating them only as fast as they're consumed. The returned
+// channel is closed once apexes is, or early if stop is closed.
+func expandWords(apexes <-chan string, words []string, stop <-chan struct{}) <-chan string {
+	names := make(chan string)
+	go func() {
+		defer close(names)
+		for apex := range apexes {
+			apex = strings.Trim(strings.TrimSpace(apex), ".")
+			if apex == "" {
+				continue
+			}
+			for _, w := range words {
+				select {
+				case names <- w + "." + apex:
+				case <-stop:
+					return
+				}
+			}
+		}
+	}()
+	return names
+}
@@ -1,19 +1,487 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
 	"math/rand"
 	"net"
 	"os"
+	"os/signal"
+	"slices"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/garmir/check-cnames/checkcname"
 	"github.com/miekg/dns"
 )
 
+var config struct {
+	concurrency         int
+	concurrencyFile     string
+	matchRanges         bool
+	groupByZone         bool
+	nsid                bool
+	spoofCheck          bool
+	retries             int
+	retryOn             map[string]bool
+	verbose             bool
+	indexFile           string
+	cnameInput          bool
+	autoWeight          bool
+	autoWeightEvery     time.Duration
+	sarifFile           string
+	dotFile             string
+	statusFiles         map[string]string
+	maxCNAMELength      int
+	maxCNAMELabels      int
+	checkDelegation     bool
+	confirmEmpty        bool
+	classifyAll         bool
+	rawTarget           bool
+	queryAuto           bool
+	resolverRate        float64
+	throttleOnRateLimit bool
+	cloakingSubnet      *net.IPNet
+	timestamps          bool
+	httpVerify          bool
+	maxErrors           errorLimit
+	maxErrorsMin        int64
+	fingerprintsFile    string
+	verifyVantages      bool
+	outputInterval      time.Duration
+	redisAddr           string
+	homoglyphCheck      bool
+	follow              bool
+	resultsBuffer       int
+	authoritative       bool
+	serviceReport       string
+	showTags            bool
+	resolveViaDoH       string
+	maxActiveZones      int
+	dropStatuses        map[string]bool
+	captureFile         string
+	replayFile          string
+	fields              []string
+	output              string
+	inputFile           string
+	maxDepth            int
+	resolvers           []string
+	rate                float64
+	summary             bool
+	tcp                 bool
+	replaceSignatures   bool
+	requireBoth         bool
+	outFile             string
+	apexFile            string
+	wordlist            string
+	wildcardCheck       bool
+	qtype               uint16
+	progress            time.Duration
+	timeout             time.Duration
+	domainTimeout       time.Duration
+	ednsBufferSize      int
+	dedup               bool
+	failOn              string
+	retryBase           time.Duration
+	retryCap            time.Duration
+	cnameOnly           bool
+	noCache             bool
+	nsTakeover          bool
+	dryRun              bool
+	maxDuration         time.Duration
+	extraTypes          []uint16
+	noRecursion         bool
+	adaptive            bool
+	evictAfter          int
+	evictCooldown       time.Duration
+	showIPs             bool
+	slowThreshold       time.Duration
+	limit               int64
+	metricsAddr         string
+	consensus           int
+	scope               []string
+	maxRetriesTotal     int64
+	normalize           bool
+	httpConcurrency     int
+	resolverStrategy    string
+	dedupMode           string
+	dedupCapacity       uint64
+	takeoverOnly        bool
+	coalesce            bool
+	nulInput            bool
+	resolveTimeout      time.Duration
+}
+
+// runCtx is cancelled once the run is interrupted or reaches -max-duration;
+// every domain's lookups run under it.
+var runCtx = context.Background()
+
 func main() {
+	flag.IntVar(&config.concurrency, "c", 20, "number of concurrent workers")
+	resolverList := flag.String("resolvers", "", "comma-separated resolver addresses (IP or IP:port, [IPv6]:port) or DNS over HTTPS URLs to use instead of the public defaults")
+	resolversFile := flag.String("resolvers-file", "", "read resolver addresses or DNS over HTTPS URLs to use instead of the public defaults from this file, one per line")
+	dohURL := flag.String("doh", "", "query CNAMEs through this DNS over HTTPS endpoint (e.g. https://cloudflare-dns.com/dns-query) instead of the public defaults")
+	flag.IntVar(&config.maxActiveZones, "max-active-zones", 0, "maximum number of registrable domains to have lookups in flight for at once (0 for unlimited)")
+	flag.BoolVar(&config.adaptive, "adaptive", false, "start with a few workers and adjust the number up to -c by how many lookups fail")
+	flag.StringVar(&config.concurrencyFile, "concurrency-file", "", "file to re-read the number of workers from on SIGHUP")
+	flag.StringVar(&config.concurrencyFile, "concurrency-from-file", "", "same as -concurrency-file")
+	flag.BoolVar(&config.matchRanges, "match-ranges", false, "also match resolving targets against service address ranges, built in or from -fingerprints")
+	flag.BoolVar(&config.groupByZone, "preserve-order-per-zone", false, "print all findings for a registrable domain together")
+	flag.BoolVar(&config.nsid, "nsid", false, "request the resolver's NSID and print it to stderr")
+	flag.BoolVar(&config.tcp, "tcp", false, "send CNAME queries over TCP instead of UDP (truncated UDP responses are always retried over TCP)")
+	flag.IntVar(&config.ednsBufferSize, "edns-buffer-size", 4096, "UDP payload size to advertise with EDNS0 on CNAME queries (0 to send them without EDNS0)")
+	flag.BoolVar(&config.spoofCheck, "spoof-check", false, "also query over DNS over TLS and flag answers that differ from UDP")
+	flag.DurationVar(&config.timeout, "t", 2*time.Second, "timeout for each DNS query")
+	flag.DurationVar(&config.resolveTimeout, "resolve-timeout", 0, "timeout for looking up the addresses of a CNAME target, which may take the system resolver several queries (0 for the same as -t)")
+	flag.DurationVar(&config.maxDuration, "max-duration", 0, "stop the whole run after this long, cutting short lookups in flight and reporting what was found (0 for no limit)")
+	flag.DurationVar(&config.slowThreshold, "slow-threshold", 0, "log domains that take longer than this to check, with how long each phase took (0 to disable)")
+	flag.DurationVar(&config.domainTimeout, "domain-timeout", 0, "give up on a domain once all its lookups, retries and HTTP checks together take this long, not counting time spent waiting for a free -http-c worker (0 for no limit)")
+	flag.BoolVar(&config.coalesce, "coalesce", false, "share one lookup between workers asking the same resolver for the same name at the same time")
+	flag.IntVar(&config.retries, "retries", 2, "number of times to retry a failed CNAME query")
+	flag.Int64Var(&config.maxRetriesTotal, "max-retries-total", 0, "retry failed queries at most this many times over the whole run (0 for unlimited)")
+	flag.DurationVar(&config.retryBase, "retry-base", 100*time.Millisecond, "longest wait before the first retry; each further retry waits up to twice as long, picked at random")
+	flag.DurationVar(&config.retryCap, "retry-cap", 2*time.Second, "longest wait before any retry")
+	retryOn := flag.String("retry-on", "timeout,servfail,connection,other", "comma-separated error classes to retry (timeout, servfail, refused, nxdomain, truncated, connection, other)")
+	flag.BoolVar(&config.takeoverOnly, "takeover-only", false, "print only takeover findings (files written with -takeovers-file and the like, and -summary, still cover everything)")
+	flag.BoolVar(&config.verbose, "v", false, "also print CNAMEs that resolve, and log at debug level unless -log-level says otherwise")
+	logLevelName := flag.String("log-level", "info", "lowest level of message to log to stderr: debug, info, warn or error")
+	flag.StringVar(&config.indexFile, "target-index", "", "write a JSON index of CNAME target to domains to this file at the end (- for stdout)")
+	flag.BoolVar(&config.cnameInput, "cname-input", false, "read domain<tab>cname pairs and only check the given CNAMEs")
+	flag.IntVar(&config.evictAfter, "evict-after", 5, "leave a resolver out of the rotation after this many failed queries in a row (0 to never)")
+	flag.DurationVar(&config.evictCooldown, "evict-cooldown", 30*time.Second, "how long an evicted resolver is left out of the rotation")
+	flag.StringVar(&config.resolverStrategy, "resolver-strategy", strategyRandom, "how each domain's resolver is picked: random, round-robin, or sticky (the same one for the same domain, retries included)")
+	flag.BoolVar(&config.autoWeight, "auto-weight", false, "probe resolver latency and prefer faster resolvers")
+	flag.DurationVar(&config.autoWeightEvery, "auto-weight-interval", 5*time.Minute, "how often to re-probe resolver latency with -auto-weight (0 to only probe at startup)")
+	flag.StringVar(&config.sarifFile, "sarif", "", "write findings as a SARIF log to this file at the end")
+	flag.StringVar(&config.serviceReport, "service-report", "", "write dangling and takeover counts per service to this file at the end (- for stdout)")
+	flag.StringVar(&config.dotFile, "dot", "", "write a Graphviz DOT graph of CNAMEs to this file at the end")
+	flag.IntVar(&config.maxDepth, "max-depth", 10, "maximum number of CNAMEs to follow in a chain before checking the last one")
+	flag.IntVar(&config.maxCNAMELength, "max-cname-length", 0, "flag CNAME targets longer than this many octets (0 to disable)")
+	flag.IntVar(&config.maxCNAMELabels, "max-cname-labels", 0, "flag CNAME targets with more than this many labels (0 to disable)")
+	flag.BoolVar(&config.requireBoth, "require-both", false, "only count CNAME targets with both IPv4 and IPv6 addresses as resolving")
+	flag.BoolVar(&config.nsTakeover, "ns-takeover", false, "also query NS records (unless -type is NS or ANY) and report nameservers that don't resolve or don't answer authoritatively for the domain as ns-takeover")
+	flag.BoolVar(&config.wildcardCheck, "wildcard-check", false, "report resolving CNAME targets under a wildcard as wildcard instead of ok")
+	flag.BoolVar(&config.checkDelegation, "check-delegation", false, "check the delegation of dangling targets to tell broken delegations apart")
+	flag.BoolVar(&config.confirmEmpty, "confirm-empty", false, "re-query a different resolver when an answer comes back completely empty")
+	flag.BoolVar(&config.confirmEmpty, "resolver-rotation-on-empty-answer", false, "same as -confirm-empty")
+	flag.BoolVar(&config.cnameOnly, "cname-only", false, "only list each domain's CNAME without checking whether it dangles or belongs to a service")
+	flag.BoolVar(&config.classifyAll, "classify-all", false, "match every CNAME against the known services, not just dangling ones")
+	flag.BoolVar(&config.classifyAll, "classify-only-resolving-providers", false, "same as -classify-all")
+	flag.BoolVar(&config.rawTarget, "raw-target", false, "print CNAME targets exactly as received instead of lowercased without the trailing dot")
+	flag.BoolVar(&config.rawTarget, "emit-raw-target-without-normalization", false, "same as -raw-target")
+	qtype := flag.String("type", "CNAME", "record type to query for: CNAME, NS, MX, SRV or ANY; the names other answers point at are checked like CNAME targets")
+	extraTypes := flag.String("extra-types", "", "comma-separated record types (MX, SRV, NS) to also query for each domain and check the targets of")
+	flag.BoolVar(&config.queryAuto, "query-auto", false, "query for A records and use the CNAME and addresses in the answer to skip separate resolution checks")
+	flag.Float64Var(&config.rate, "rate", 0, "maximum queries per second to send in total across all resolvers (0 for unlimited)")
+	flag.Float64Var(&config.resolverRate, "resolver-rate", 0, "maximum queries per second to send to each resolver (0 for unlimited)")
+	flag.BoolVar(&config.throttleOnRateLimit, "throttle-on-rate-limit", false, "slow down queries to resolvers that signal they are rate limiting, by bursts of REFUSED, truncated empty answers or Extended DNS Errors")
+	cloaking := flag.String("cloaking-check", "", "re-query with this EDNS client subnet (e.g. 73.0.0.0/24) and flag CNAMEs that differ; needs resolvers that honor ECS")
+	flag.StringVar(&config.resolveViaDoH, "resolve-via-doh", "", "check whether CNAME targets resolve through this DNS over HTTPS endpoint (e.g. https://cloudflare-dns.com/dns-query) instead of the system resolver")
+	flag.DurationVar(&config.progress, "progress", 0, "print how many domains have been dispatched and completed to stderr this often (e.g. 10s)")
+	flag.StringVar(&config.failOn, "fail-on", "", "exit 2 if there were any takeovers (takeover), or also 3 if there were only dangling CNAMEs (dangling)")
+	flag.StringVar(&config.metricsAddr, "metrics-addr", "", "serve Prometheus metrics at /metrics on this address while running")
+	flag.BoolVar(&config.summary, "summary", false, "print a tally of the results to stderr at the end")
+	flag.BoolVar(&config.showIPs, "show-ips", false, "include the addresses resolving CNAME targets point at")
+	flag.BoolVar(&config.showTags, "show-tags", false, "append the key=value tags from each input line to its results")
+	flag.BoolVar(&config.timestamps, "timestamps", false, "prefix each result with the time it was determined")
+	flag.IntVar(&config.httpConcurrency, "http-c", 10, "number of concurrent HTTP confirmations, run apart from the DNS workers")
+	flag.BoolVar(&config.httpVerify, "http-verify", false, "confirm takeovers by probing the domain over HTTP for its service's fingerprint; without it, dangling targets at services only their fingerprint shows to be unclaimed are needs-confirmation, and nothing is fetched")
+	flag.BoolVar(&config.httpVerify, "confirm", false, "same as -http-verify")
+	maxErrors := flag.String("max-errors", "", "abort once this many lookups (e.g. 100) or this share of them (e.g. 50%) have failed")
+	flag.Int64Var(&config.maxErrorsMin, "max-errors-min", 100, "number of domains processed before a -max-errors rate applies")
+	flag.StringVar(&config.fingerprintsFile, "fingerprints", "", "load extra service fingerprints from this file (subjack's fingerprints.json, or a JSON or YAML list of service, pattern and fingerprint, and optionally the method, path and host to request; either may give the CIDR ranges of -match-ranges)")
+	flag.StringVar(&config.fingerprintsFile, "signatures", "", "same as -fingerprints")
+	flag.BoolVar(&config.replaceSignatures, "replace-signatures", false, "use only the services from -fingerprints instead of adding them to the built-in ones")
+	flag.IntVar(&config.consensus, "consensus", 0, "ask this many resolvers whether a dangling target resolves and report it as dangling-partial unless most say it doesn't")
+	flag.BoolVar(&config.verifyVantages, "verify-vantages", false, "check dangling targets against every resolver and report ones not all of them agree on as dangling-partial; resolvers that fail to answer count as disagreeing")
+	flag.BoolVar(&config.verifyVantages, "verify-dangling-from-multiple-vantages", false, "same as -verify-vantages")
+	flag.DurationVar(&config.outputInterval, "output-interval", 0, "flush held back results and rewrite end-of-run reports this often (breaks up zone grouping)")
+	flag.BoolVar(&config.noCache, "no-cache", false, "don't reuse responses and resolution checks across domains")
+	flag.StringVar(&config.redisAddr, "redis-addr", "", "share cached responses through the Redis server at this address (needs -tags redis)")
+	flag.BoolVar(&config.homoglyphCheck, "homoglyph-check", false, "flag internationalized CNAME targets that imitate well-known domains")
+	flag.BoolVar(&config.homoglyphCheck, "normalize-unicode-confusables", false, "same as -homoglyph-check")
+	flag.BoolVar(&config.follow, "follow", false, "keep reading pipes after EOF and run until interrupted")
+	flag.BoolVar(&config.noRecursion, "no-recursion", false, "send queries without asking for recursion, following any referrals to the nameservers they point at")
+	flag.BoolVar(&config.authoritative, "authoritative", false, "query each domain's authoritative nameservers directly for its CNAME instead of the resolvers")
+	flag.IntVar(&config.resultsBuffer, "results-buffer", 0, "number of results to buffer for the printer (0 for the number of workers)")
+	dropWhenFull := flag.String("drop-when-full", "", "comma-separated statuses to drop rather than wait for when the results buffer is full (never takeover)")
+	flag.StringVar(&config.captureFile, "capture", "", "record raw DNS responses to this file")
+	flag.StringVar(&config.replayFile, "replay", "", "answer DNS queries from a file written by -capture instead of the network")
+	config.statusFiles = make(map[string]string)
+	takeoversFile := flag.String("takeovers-file", "", "also write takeover findings, ns-takeover included, to this file")
+	danglingFile := flag.String("dangling-file", "", "also write dangling findings, dangling-partial and needs-confirmation included, to this file")
+	okFile := flag.String("ok-file", "", "also write CNAMEs that resolve to this file")
+	fields := flag.String("output-only-fields", "", "comma-separated columns to print as TSV, or as CSV with -o csv (domain, cname, status, service, resolver, detail, type, ttl, addresses, confidence, timestamp, tags)")
+	flag.BoolVar(&config.dryRun, "dry-run", false, "only read and validate the input, print the settings a run would use and exit (1 if any domain is invalid) without sending queries")
+	flag.BoolVar(&config.nulInput, "0", false, "read input entries separated by NUL bytes instead of newlines, as from find -print0")
+	flag.StringVar(&config.inputFile, "i", "", "read domains from this file (as well as any given as arguments) instead of stdin")
+	flag.StringVar(&config.wordlist, "wordlist", "", "check label.apex for every label in this file and every apex domain read from the input")
+	flag.StringVar(&config.wordlist, "w", "", "same as -wordlist")
+	flag.Int64Var(&config.limit, "limit", 0, "stop reading input after this many domains have been dispatched (0 for unlimited)")
+	scopeList := flag.String("scope", "", "comma-separated apex domains to limit the run to; domains not under one of them are skipped")
+	scopeFile := flag.String("scope-file", "", "read apex domains for -scope from this file, one per line")
+	flag.BoolVar(&config.normalize, "normalize", false, "reduce input given as URLs (https://sub.example.com/path) or with a port to the hostname, and strip leading *. wildcards")
+	flag.BoolVar(&config.dedup, "dedup", false, "skip domains that have already been read once")
+	flag.StringVar(&config.dedupMode, "dedup-mode", dedupMemory, "how -dedup remembers domains: memory (every domain, exactly) or bloom (fixed memory, but about 1 in 1000 new domains is wrongly skipped once -dedup-capacity have been read)")
+	flag.Uint64Var(&config.dedupCapacity, "dedup-capacity", 100_000_000, "number of domains to size the -dedup-mode bloom filter for (about 1.8 bytes each)")
+	flag.StringVar(&config.apexFile, "apex-file", "", "read apex domains for -wordlist from this file")
+	flag.StringVar(&config.outFile, "out", "", "write results to this file instead of stdout")
+	flag.StringVar(&config.output, "o", outputText, "output format: text, json (one object per line), json-array (a single array, streamed as results come in and closed when the run ends, interrupted or not) or csv")
+	flag.Parse()
+
+	for status, path := range map[string]string{
+		statusTakeover: *takeoversFile,
+		statusDangling: *danglingFile,
+		statusOK:       *okFile,
+	} {
+		if path != "" {
+			config.statusFiles[status] = path
+		}
+	}
+
+	level, err := parseLogLevel(*logLevelName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	if config.resolveTimeout <= 0 {
+		config.resolveTimeout = config.timeout
+	}
+
+	if config.verbose && !flagGiven("log-level") {
+		level = slog.LevelDebug
+	}
+	logLevel.Set(level)
+
+	config.retryOn, err = parseErrorClasses(*retryOn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	if *maxErrors != "" {
+		config.maxErrors, err = parseErrorLimit(*maxErrors)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if config.ednsBufferSize != 0 && (config.ednsBufferSize < dns.MinMsgSize || config.ednsBufferSize > dns.MaxMsgSize) {
+		fmt.Fprintf(os.Stderr, "-edns-buffer-size must be 0 or between %d and %d\n", dns.MinMsgSize, dns.MaxMsgSize)
+		os.Exit(1)
+	}
+
+	switch config.failOn {
+	case "", statusTakeover, statusDangling:
+	default:
+		fmt.Fprintf(os.Stderr, "-fail-on must be takeover or dangling\n")
+		os.Exit(1)
+	}
+
+	if *scopeList != "" || *scopeFile != "" {
+		var entries []string
+		if *scopeList != "" {
+			entries = strings.Split(*scopeList, ",")
+		}
+		if *scopeFile != "" {
+			lines, err := readScope(*scopeFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to read scope: %s\n", err)
+				os.Exit(1)
+			}
+			entries = append(entries, lines...)
+		}
+		scope, err := parseScope(entries)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -scope: %s\n", err)
+			os.Exit(1)
+		}
+		if len(scope) == 0 {
+			fmt.Fprintf(os.Stderr, "-scope has no apex domains\n")
+			os.Exit(1)
+		}
+		config.scope = scope
+	}
+
+	if config.resolverStrategy, err = parseStrategy(config.resolverStrategy); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	if config.autoWeight && config.resolverStrategy != strategyRandom {
+		fmt.Fprintf(os.Stderr, "-auto-weight only works with -resolver-strategy random\n")
+		os.Exit(1)
+	}
+
+	if config.dedupMode != dedupMemory && config.dedupMode != dedupBloom {
+		fmt.Fprintf(os.Stderr, "-dedup-mode must be memory or bloom\n")
+		os.Exit(1)
+	}
+	if (flagGiven("dedup-mode") || flagGiven("dedup-capacity")) && !config.dedup {
+		fmt.Fprintf(os.Stderr, "-dedup-mode and -dedup-capacity need -dedup\n")
+		os.Exit(1)
+	}
+
+	if config.httpConcurrency < 1 {
+		fmt.Fprintf(os.Stderr, "-http-c must be at least 1\n")
+		os.Exit(1)
+	}
+
+	if config.consensus < 0 {
+		fmt.Fprintf(os.Stderr, "-consensus must not be negative\n")
+		os.Exit(1)
+	}
+
+	if config.limit < 0 {
+		fmt.Fprintf(os.Stderr, "-limit must not be negative\n")
+		os.Exit(1)
+	}
+
+	if config.adaptive && config.concurrencyFile != "" {
+		fmt.Fprintf(os.Stderr, "-adaptive and -concurrency-file don't go together\n")
+		os.Exit(1)
+	}
+
+	if config.apexFile != "" && config.wordlist == "" {
+		fmt.Fprintf(os.Stderr, "-apex-file needs a -wordlist\n")
+		os.Exit(1)
+	}
+
+	if config.resolveViaDoH != "" && !strings.HasPrefix(config.resolveViaDoH, "https://") {
+		fmt.Fprintf(os.Stderr, "invalid DoH endpoint %q: must be an https:// URL\n", config.resolveViaDoH)
+		os.Exit(1)
+	}
+
+	switch t := strings.ToUpper(*qtype); t {
+	case "CNAME", "NS", "MX", "SRV", "ANY":
+		config.qtype = dns.StringToType[t]
+		if config.queryAuto && config.qtype != dns.TypeCNAME {
+			fmt.Fprintf(os.Stderr, "-query-auto only works with -type CNAME\n")
+			os.Exit(1)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unsupported query type %q\n", *qtype)
+		os.Exit(1)
+	}
+
+	for _, t := range strings.Split(*extraTypes, ",") {
+		switch t = strings.ToUpper(strings.TrimSpace(t)); t {
+		case "":
+		case "MX", "SRV", "NS":
+			config.extraTypes = append(config.extraTypes, dns.StringToType[t])
+		default:
+			fmt.Fprintf(os.Stderr, "unsupported extra query type %q\n", t)
+			os.Exit(1)
+		}
+	}
+	// the NS check comes on top of whatever -type asks for
+	if config.nsTakeover && config.qtype != dns.TypeNS && config.qtype != dns.TypeANY && !slices.Contains(config.extraTypes, dns.TypeNS) {
+		config.extraTypes = append(config.extraTypes, dns.TypeNS)
+	}
+
+	if *dropWhenFull != "" {
+		config.dropStatuses, err = parseDropStatuses(*dropWhenFull)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *cloaking != "" {
+		_, config.cloakingSubnet, err = net.ParseCIDR(*cloaking)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid cloaking subnet: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	switch config.output {
+	case outputText, outputJSON, outputJSONArray, outputCSV:
+	default:
+		fmt.Fprintf(os.Stderr, "unknown output format %q\n", config.output)
+		os.Exit(1)
+	}
+
+	if *fields != "" {
+		if config.output != outputText && config.output != outputCSV {
+			fmt.Fprintf(os.Stderr, "-output-only-fields only applies to text and CSV output\n")
+			os.Exit(1)
+		}
+		config.fields, err = parseFields(*fields)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if config.fingerprintsFile != "" {
+		loaded, err := loadFingerprints(config.fingerprintsFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load fingerprints: %s\n", err)
+			os.Exit(1)
+		}
+		addServices(loaded)
+	}
+
+	if config.replayFile != "" {
+		rp, err := loadReplay(config.replayFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load replay file: %s\n", err)
+			os.Exit(1)
+		}
+		newExchanger = func(string) exchanger { return rp }
+		systemResolver = replayResolver{rp}
+	}
+
+	if config.captureFile != "" {
+		capture, err := newCaptureWriter(config.captureFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to create capture file: %s\n", err)
+			os.Exit(1)
+		}
+		defer capture.Close()
+
+		inner := newExchanger
+		newExchanger = func(network string) exchanger {
+			return capturingExchanger{inner(network), capture}
+		}
+		systemResolver = capturingResolver{systemResolver, capture}
+	}
+
+	// limited below the cache, so that cached answers aren't held back
+	inner := newExchanger
+	newExchanger = func(network string) exchanger {
+		return limitingExchanger{inner(network)}
+	}
+
+	if config.redisAddr != "" {
+		if config.noCache {
+			fmt.Fprintf(os.Stderr, "-no-cache and -redis-addr don't go together\n")
+			os.Exit(1)
+		}
+		responseCache, err = newSharedCache(config.redisAddr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+	} else if !config.noCache {
+		responseCache = newMemoryCache()
+	}
+
+	if responseCache != nil {
+		inner := newExchanger
+		newExchanger = func(network string) exchanger {
+			if network != "udp" && network != "https" {
+				return inner(network)
+			}
+			return cachingExchanger{inner(network)}
+		}
+	}
 
 	servers := []string{
 		//"209.244.0.3",
@@ -59,78 +527,718 @@ func main() {
 		//	"45.77.165.194",
 	}
 
+	if *resolverList != "" || *resolversFile != "" || *dohURL != "" {
+		var entries []string
+		if *dohURL != "" {
+			entries = append(entries, *dohURL)
+		}
+		if *resolverList != "" {
+			entries = append(entries, strings.Split(*resolverList, ",")...)
+		}
+		if *resolversFile != "" {
+			lines, err := readResolvers(*resolversFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to read resolvers: %s\n", err)
+				os.Exit(1)
+			}
+			entries = append(entries, lines...)
+		}
+
+		if custom := parseResolvers(entries); len(custom) > 0 {
+			servers = custom
+		} else {
+			slog.Warn("no usable resolvers given, using the defaults")
+		}
+	}
+	config.resolvers = servers
+
 	rand.Seed(time.Now().Unix())
 
-	type job struct{ domain, server string }
+	globalLimiter = newGlobalLimiter(config.rate)
+
+	resolvers = newResolverPool(config.resolvers)
+	if config.consensus > len(config.resolvers) {
+		slog.Warn("fewer resolvers than -consensus, asking them all", "consensus", config.consensus, "resolvers", len(config.resolvers))
+	}
+	if config.autoWeight && !config.dryRun {
+		resolvers.autoWeight(config.autoWeightEvery)
+	}
+
 	jobs := make(chan job)
+	if config.resultsBuffer <= 0 {
+		config.resultsBuffer = config.concurrency
+	}
+	results := make(chan Result, config.resultsBuffer)
 
-	var wg sync.WaitGroup
-	for i := 0; i < 20; i++ {
-		wg.Add(1)
+	var groups *zoneGroups
+	if config.groupByZone {
+		groups = newZoneGroups(results)
+	}
+
+	sem := newSemaphore(config.concurrency)
+	if config.concurrencyFile != "" {
+		reloadConcurrencyOnHUP(config.concurrencyFile, sem)
+	}
+	if config.adaptive {
+		adaptConcurrency(sem, config.concurrency, time.Second)
+	}
+
+	var gate *zoneGate
+	if config.maxActiveZones > 0 {
+		gate = newZoneGate(config.maxActiveZones)
+	}
+
+	// workCtx ends with -max-duration, and runCtx with that or an
+	// interrupt
+	workCtx := context.Background()
+	if config.maxDuration > 0 {
+		var cancel context.CancelFunc
+		workCtx, cancel = context.WithTimeout(workCtx, config.maxDuration)
+		defer cancel()
+	}
+
+	// the first interrupt stops reading input and cancels the lookups in
+	// flight, whose domains are then given up on, so that the results so
+	// far and the summary are still written; a second one kills the
+	// process as usual. Reaching -max-duration does the same.
+	var stopSignals context.CancelFunc
+	runCtx, stopSignals = signal.NotifyContext(workCtx, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-runCtx.Done()
+		stopSignals()
+		if workCtx.Err() != nil {
+			slog.Warn("reached -max-duration, stopping", "after", config.maxDuration)
+		} else {
+			slog.Info("interrupted, stopping")
+		}
+	}()
+
+	// finish hands a domain's results, confirmed where they need to be, on
+	// to the printer
+	finish := func(p pending) {
+		defer p.cancel()
+		if p.timings != nil {
+			p.timings.logSlow(p.j.domain, time.Since(p.start))
+		}
+
+		stats.domains.Add(1)
+		now := time.Now()
+		for i := range p.rs {
+			p.rs[i].Timestamp = now
+			p.rs[i].Tags = p.j.tags
+			scoreResult(&p.rs[i])
+			countResult(p.rs[i])
+			serviceCounts.add(p.rs[i])
+		}
+		if groups != nil {
+			groups.done(p.j.zone, p.rs)
+			return
+		}
+		for _, r := range p.rs {
+			sendResult(results, r)
+		}
+	}
 
+	// HTTP confirmations run in a pool of their own so that slow web
+	// servers don't hold up DNS workers; only a full queue does
+	confirms := make(chan pending, config.concurrency)
+	var confirmed sync.WaitGroup
+	for i := 0; i < config.httpConcurrency; i++ {
+		confirmed.Add(1)
 		go func() {
-			for j := range jobs {
+			defer confirmed.Done()
+			for p := range confirms {
+				ctx, cancel := confirmContext(p)
+				p.rs = confirmResults(ctx, p.j.domain, p.rs)
+				cancel()
+				finish(p)
+			}
+		}()
+	}
+
+	go func() {
+		var wg sync.WaitGroup
+		for j := range jobs {
+			var zone string
+			if gate != nil {
+				zone = zoneOf(j.domain)
+				gate.acquire(zone)
+			}
+			sem.acquire()
+			wg.Add(1)
 
-				cname, err := getCNAME(j.domain, j.server)
-				if err != nil {
-					//fmt.Println(err)
-					continue
+			go func(j job) {
+				defer wg.Done()
+				defer sem.release()
+				if gate != nil {
+					defer gate.release(zone)
 				}
 
-				if !resolves(cname) {
-					fmt.Printf("%s does not resolve (pointed at by %s)\n", cname, j.domain)
+				p := pending{j: j, ctx: runCtx, cancel: func() {}}
+				if config.domainTimeout > 0 {
+					p.ctx, p.cancel = context.WithTimeout(p.ctx, config.domainTimeout)
 				}
-			}
-			wg.Done()
-		}()
+				if config.slowThreshold > 0 {
+					p.ctx, p.timings = withTimings(p.ctx)
+					p.start = time.Now()
+				}
+
+				begun := time.Now()
+				p.rs = processDomain(p.ctx, j)
+				if needsConfirmation(p.rs) {
+					p.left = config.domainTimeout - time.Since(begun)
+					confirms <- p
+					return
+				}
+				finish(p)
+			}(j)
+		}
+		wg.Wait()
+		close(confirms)
+		confirmed.Wait()
+		close(results)
+	}()
+
+	paths := flag.Args()
+	if config.inputFile != "" {
+		paths = append([]string{config.inputFile}, paths...)
+	}
+	if config.apexFile != "" {
+		paths = append([]string{config.apexFile}, paths...)
+	}
+	inputs, err := openInputs(paths)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open input: %s\n", err)
+		os.Exit(1)
+	}
+
+	var words []string
+	if config.wordlist != "" {
+		words, err = readWordlist(config.wordlist)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read wordlist: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if config.dryRun {
+		lines := readLines(inputs, nil)
+		if config.wordlist != "" {
+			lines = expandWords(lines, words, nil)
+		}
+		if _, invalid := dryRun(os.Stdout, lines); invalid > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// started before any output is, so that failing to start it doesn't
+	// leave output behind that was begun but never finished
+	if config.metricsAddr != "" {
+		if err := serveMetrics(runCtx, config.metricsAddr); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to serve metrics: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var out *statusFile
+	if config.outFile != "" {
+		out, err = createStatusFile(config.outFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	files, err := openStatusFiles()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	printed := make(chan struct{})
+	go func() {
+		printResults(results, out, files)
+		close(printed)
+	}()
+
+	lines := readLines(inputs, runCtx.Done())
+	if config.wordlist != "" {
+		lines = expandWords(lines, words, runCtx.Done())
+	}
+
+	var progressed <-chan struct{}
+	if config.progress > 0 {
+		progressed = reportProgress(os.Stderr, config.progress, printed)
 	}
 
-	sc := bufio.NewScanner(os.Stdin)
+	var lastZone string
+	var aborted bool
+	var seen seenSet
+	if config.dedup {
+		seen = newSeenSet(config.dedupMode, config.dedupCapacity)
+	}
+	for line := range lines {
+		if config.maxErrors.exceeded(config.maxErrorsMin) {
+			slog.Error("aborting, too many lookups failed", "failed", stats.errors.Load(), "processed", stats.processed.Load())
+			aborted = true
+			break
+		}
 
-	for sc.Scan() {
-		target := strings.ToLower(strings.TrimSpace(sc.Text()))
+		target, cname, tags, err := parseLine(line)
+		if err != nil {
+			slog.Warn("skipping line", "line", line, "err", err)
+			continue
+		}
 		if target == "" {
 			continue
 		}
-		server := servers[rand.Intn(len(servers))]
+		if !inScope(target) {
+			stats.outOfScope.Add(1)
+			slog.Debug("skipping domain out of scope", "domain", target)
+			continue
+		}
+		if config.dedup {
+			if seen.add(normalizeName(target)) {
+				stats.duplicates.Add(1)
+				continue
+			}
+		}
+
+		var server string
+		if !config.cnameInput {
+			server = resolvers.pickFor(target)
+		}
 
-		jobs <- job{target, server}
+		j := job{domain: target, server: server, cname: cname, tags: tags}
+		if groups != nil {
+			j.zone = zoneOf(target)
+			if j.zone != lastZone {
+				groups.close(lastZone)
+				lastZone = j.zone
+			}
+			groups.add(j.zone)
+		}
+
+		jobs <- j
+		if n := stats.dispatched.Add(1); config.limit > 0 && n >= config.limit {
+			slog.Debug("reached -limit, not reading any more input", "limit", config.limit)
+			break
+		}
+	}
+	if groups != nil {
+		groups.close(lastZone)
 	}
 	close(jobs)
 
-	wg.Wait()
+	<-printed
+	if progressed != nil {
+		<-progressed
+	}
 
+	if config.summary {
+		writeSummary(os.Stderr)
+	} else if n := stats.dropped.Load(); n > 0 {
+		slog.Warn("dropped results the printer couldn't keep up with", "dropped", n)
+	}
+
+	// following input only ever ends with an interrupt; a run cut short
+	// by -max-duration isn't a failure in itself
+	interrupted := runCtx.Err() != nil && workCtx.Err() == nil
+	if aborted || interrupted && !config.follow {
+		os.Exit(1)
+	}
+	if code := findingsExitCode(); code != 0 {
+		os.Exit(code)
+	}
 }
 
-func resolves(domain string) bool {
-	_, err := net.LookupHost(domain)
-	return err == nil
+type job struct {
+	domain, server string
+
+	// cname is the already known CNAME target for domain, if any; when set
+	// the CNAME lookup is skipped
+	cname string
+
+	// zone is the registrable domain the job belongs to; it is only set
+	// when grouping output by zone
+	zone string
+
+	// tags are the key=value pairs from the input line, copied onto every
+	// result
+	tags map[string]string
 }
 
-func getCNAME(domain, server string) (string, error) {
-	c := dns.Client{}
+// pending is a job that's been processed, on its way to the printer.
+type pending struct {
+	j      job
+	rs     []Result
+	ctx    context.Context
+	cancel context.CancelFunc
 
-	m := dns.Msg{}
-	if domain[len(domain)-1:] != "." {
-		domain += "."
+	// timings and start are set with config.slowThreshold
+	timings *timings
+	start   time.Time
+
+	// left is what's left of config.domainTimeout for confirming rs
+	// once the lookups are done
+	left time.Duration
+}
+
+// confirmContext returns the context to confirm p's results over HTTP
+// under. It gets what the lookups left of -domain-timeout, counted from
+// when confirming starts, since time spent waiting for a free HTTP worker
+// doesn't count against the domain; the run ending still ends it.
+func confirmContext(p pending) (context.Context, context.CancelFunc) {
+	ctx, cancel := runCtx, context.CancelFunc(func() {})
+	if config.domainTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, p.left)
+	}
+	if p.timings != nil {
+		ctx = withTimingsOf(ctx, p.timings)
 	}
-	m.SetQuestion(domain, dns.TypeCNAME)
-	m.RecursionDesired = true
+	return ctx, cancel
+}
 
-	r, _, err := c.Exchange(&m, server+":53")
+// processDomain looks up and checks the CNAME of j's domain, and the
+// targets of any config.extraTypes records, giving up on whatever is left
+// once ctx is done. Results that need confirming over HTTP are left for
+// confirmResults.
+func processDomain(ctx context.Context, j job) []Result {
+	rs := checkDomain(ctx, j)
+	// the known CNAME of -cname-input is all there is to check
+	if j.server == "" {
+		return rs
+	}
+	for _, t := range config.extraTypes {
+		rs = append(rs, checkRecords(ctx, j, t)...)
+	}
+	return rs
+}
+
+// checkRecords looks up j's domain's records of type qtype and checks the
+// names they point at.
+func checkRecords(ctx context.Context, j job, qtype uint16) []Result {
+	done := startPhase(ctx, phaseQuery)
+	res, err := getRecordsWithRetry(ctx, j.domain, j.server, qtype)
+	done()
 	if err != nil {
-		return "", err
+		slog.Debug("lookup failed", "domain", j.domain, "type", dns.TypeToString[qtype], "err", err)
+		return nil
 	}
 
-	if len(r.Answer) == 0 {
-		return "", fmt.Errorf("no answers for %s", domain)
+	check := checkTarget
+	if config.cnameOnly {
+		check = listTarget
+	} else if qtype == dns.TypeNS && config.nsTakeover {
+		check = checkNameserver
 	}
 
-	for _, ans := range r.Answer {
-		if r, ok := ans.(*dns.CNAME); ok {
-			return r.Target, nil
+	var rs []Result
+	for _, t := range res.targets {
+		// the CNAME a domain has instead is checked already
+		if t.rrtype != qtype {
+			continue
 		}
+		r := check(ctx, j.domain, cnameResult{target: t.name}, res.server)
+		if timedOut(ctx, j.domain) {
+			return rs
+		}
+		r.RecordType = dns.TypeToString[t.rrtype]
+		rs = append(rs, r)
 	}
-	return "", fmt.Errorf("no cname for %s", domain)
+	return rs
+}
+
+// checkDomain looks up and checks the records of config.qtype for j's
+// domain.
+func checkDomain(ctx context.Context, j job) []Result {
+	var rs []Result
+
+	res := cnameResult{target: j.cname}
+	if res.target == "" {
+		done := startPhase(ctx, phaseQuery)
+		server := j.server
+		if config.authoritative {
+			ns, err := authoritativeServer(ctx, j.domain, j.server)
+			if err != nil {
+				slog.Warn("no authoritative nameserver, using the resolver", "domain", j.domain, "resolver", j.server, "err", err)
+			} else {
+				server = ns
+			}
+		}
 
+		// -spoof-check compares this very answer with one over TLS
+		qctx := ctx
+		if config.spoofCheck {
+			qctx = bypassCache(ctx)
+		}
+		var err error
+		res, err = getCNAMEWithRetry(qctx, j.domain, server)
+		done()
+		if !config.authoritative {
+			// retries may have moved on to another resolver
+			j.server = res.server
+		}
+		stats.processed.Add(1)
+		switch classifyDNSError(err, res.rcode) {
+		case "", errClassNXDomain:
+		default:
+			stats.errors.Add(1)
+		}
+		if config.spoofCheck {
+			if r, ok := checkTransports(ctx, j.domain, j.server, res.target, err); ok {
+				rs = append(rs, r)
+			}
+		}
+		if config.cloakingSubnet != nil && (err == nil || errors.Is(err, errNoCNAME)) {
+			if r, ok := checkCloaking(ctx, j.domain, j.server, res.target); ok {
+				rs = append(rs, r)
+			}
+		}
+		if err != nil {
+			slog.Debug("lookup failed", "domain", j.domain, "err", err)
+			return rs
+		}
+	}
+	stats.cnames.Add(1)
+
+	check := checkTarget
+	if config.cnameOnly {
+		check = listTarget
+	} else {
+		if r, ok := checkLength(j.domain, res.target, j.server); ok {
+			rs = append(rs, r)
+		}
+		if config.homoglyphCheck {
+			if r, ok := checkHomoglyph(j.domain, res.target, j.server); ok {
+				rs = append(rs, r)
+			}
+		}
+	}
+
+	// the known CNAME of -cname-input has no resolver to follow it with,
+	// and -query-auto's answer came with the whole chain
+	if config.maxDepth > 1 && j.server != "" && res.targets == nil && !config.queryAuto {
+		done := startPhase(ctx, phaseQuery)
+		res = followChain(ctx, res, j.server)
+		done()
+	}
+
+	if res.targets != nil {
+		for _, t := range res.targets {
+			c := check
+			if t.rrtype == dns.TypeNS && config.nsTakeover && !config.cnameOnly {
+				c = checkNameserver
+			}
+			r := c(ctx, j.domain, cnameResult{target: t.name}, j.server)
+			if timedOut(ctx, j.domain) {
+				return rs
+			}
+			r.RecordType = dns.TypeToString[t.rrtype]
+			rs = append(rs, r)
+		}
+		return rs
+	}
+
+	r := check(ctx, j.domain, res, j.server)
+	if timedOut(ctx, j.domain) {
+		return rs
+	}
+	return append(rs, r)
+}
+
+// timedOut reports whether ctx ended before domain was fully checked, in
+// which case whatever the check found can't be trusted; a lookup cut short
+// looks just like a target that doesn't resolve.
+func timedOut(ctx context.Context, domain string) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+	stats.errors.Add(1)
+	slog.Warn("gave up on domain", "domain", domain, "err", ctx.Err())
+	return true
+}
+
+// checkLength flags CNAME targets that are unusually long or have an
+// unusually large number of labels, which can be a sign of a DNS tunnel or
+// broken configuration.
+func checkLength(domain, cname, server string) (Result, bool) {
+	target := strings.ToLower(strings.TrimSuffix(cname, "."))
+	length := len(target)
+	labels := dns.CountLabel(target)
+
+	if (config.maxCNAMELength <= 0 || length <= config.maxCNAMELength) &&
+		(config.maxCNAMELabels <= 0 || labels <= config.maxCNAMELabels) {
+		return Result{}, false
+	}
+
+	return Result{
+		Domain:   domain,
+		CNAME:    target,
+		Status:   statusSuspiciousLength,
+		Detail:   fmt.Sprintf("%d octets, %d labels", length, labels),
+		Resolver: server,
+	}, true
+}
+
+// targetResult is the result for domain's CNAME target before anything is
+// known about it.
+func targetResult(domain string, res cnameResult, server string) Result {
+	r := Result{
+		Domain:   domain,
+		CNAME:    normalizeName(res.target),
+		RawCNAME: res.target,
+		Resolver: server,
+		TTL:      res.ttl,
+	}
+	for _, c := range res.chain {
+		r.Chain = append(r.Chain, normalizeName(c))
+	}
+	return r
+}
+
+// listTarget is checkTarget for -cname-only; it only records the target.
+func listTarget(_ context.Context, domain string, res cnameResult, server string) Result {
+	r := targetResult(domain, res, server)
+	r.Status = statusCNAME
+	return r
+}
+
+// checkTarget decides whether the CNAME target of domain is dangling and
+// which service, if any, it belongs to. That's checkcname.Check, with the
+// checks of the command's options around it.
+func checkTarget(ctx context.Context, domain string, res cnameResult, server string) Result {
+	r := targetResult(domain, res, server)
+
+	// CNAMEs can only point at names, but some zones have an address in
+	// there anyway; there's nothing to resolve
+	if net.ParseIP(r.CNAME) != nil {
+		r.Status = statusMalformedCNAMEIP
+		return r
+	}
+
+	// with the target known, Check can only fail resolving it, and a
+	// target that couldn't be looked up may well resolve
+	var resolved bool
+	var addrs []string
+	cr, err := checkcname.Check(ctx, domain, checkcname.Options{
+		CNAME:    r.CNAME,
+		Services: vulnerableServices,
+		Resolves: func(ctx context.Context, _ string) (bool, error) {
+			var err error
+			addrs, resolved, err = resolveTarget(ctx, &r, res)
+			return resolved, err
+		},
+	})
+	if err != nil {
+		lookupError(ctx, &r, err)
+		return r
+	}
+	r.Status, r.Service = cr.Status, cr.Service
+
+	if !resolved {
+		if config.checkDelegation {
+			ds := server
+			if ds == "" {
+				ds = resolvers.pick()
+			}
+			if reason, broken := checkDelegation(ctx, r.CNAME, ds); broken {
+				r.Status = statusDelegationBroken
+				r.Service = ""
+				r.Detail = reason
+				return r
+			}
+		}
+
+		if config.consensus > 1 {
+			checkConsensus(ctx, &r, server)
+		}
+		if config.verifyVantages && r.Status != statusDanglingPartial {
+			checkVantages(ctx, &r)
+		}
+	} else {
+		// a resolving target's service is only of interest with
+		// -classify-all, or when it can be checked anyway below
+		matched := r.Service
+		if r.Status == statusService && !config.classifyAll {
+			r.Status, r.Service = statusOK, ""
+		}
+		if r.Service == "" && config.matchRanges {
+			if r.Service = checkServiceRanges(addrs); r.Service != "" {
+				r.Status = statusService
+			}
+		}
+
+		if config.wildcardCheck {
+			if parent, ok := hasWildcard(ctx, r.CNAME); ok {
+				r.Status = statusWildcard
+				r.Detail = "wildcard at " + parent
+			}
+		}
+
+		// with -http-verify, services recognised by their fingerprint
+		// are probed whether the target resolves or not, and so is
+		// CloudFront, since a distribution that still exists can have
+		// stopped serving the domain
+		if config.httpVerify && r.Status == statusOK && r.Service == "" && matched != "" &&
+			(detectionOf(matched) == detectHTTP || matched == cloudFront) {
+			r.Service = matched
+			r.guessed = true
+		}
+	}
+
+	// fetching anything from the domain is up to -http-verify; without
+	// it, targets that only a fingerprint would show to be unclaimed are
+	// left needing confirmation
+	r.confirm = config.httpVerify && r.Service != "" && r.Status != statusDanglingPartial
+	if r.confirm && r.Status == statusNeedsConfirmation {
+		r.Status = statusDangling
+	}
+
+	if r.guessed && !r.confirm && r.Status != statusTakeover {
+		r.Service = ""
+	}
+	return r
+}
+
+// lookupError marks r as a target whose addresses couldn't be looked up.
+// One cut short by ctx isn't counted; timedOut counts the domain.
+func lookupError(ctx context.Context, r *Result, err error) {
+	if ctx.Err() == nil {
+		stats.errors.Add(1)
+	}
+	r.Status = statusLookupError
+	r.Service = ""
+	r.Detail = err.Error()
+}
+
+// resolveTarget reports whether r's CNAME target resolves, going by what
+// the response for res already showed where it can, and returns the
+// addresses it was looked up to have. An A query's answer says nothing
+// about AAAA records, or about which addresses there are beyond the first
+// name's, so with config.requireBoth, config.showIPs or config.matchRanges
+// it's looked up anyway. The error is set when the lookup failed rather
+// than finding no addresses.
+func resolveTarget(ctx context.Context, r *Result, res cnameResult) ([]string, bool, error) {
+	resolved := res.resolution == resolutionResolves
+	if res.resolution != resolutionUnknown && !((config.requireBoth || config.showIPs || config.matchRanges) && resolved) {
+		return nil, resolved, nil
+	}
+
+	done := startPhase(ctx, phaseResolve)
+	addrs, err := resolves(ctx, r.CNAME)
+	done()
+	if lookupFailed(err) {
+		return nil, false, err
+	}
+	f := familiesOf(addrs)
+	resolved = f.resolves()
+	if !resolved && f != 0 {
+		r.Detail = f.String()
+	}
+	if resolved && config.showIPs {
+		r.Addresses = addrs
+	}
+	return addrs, resolved, nil
 }
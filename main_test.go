@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCNAMEToAddress(t *testing.T) {
+	for _, target := range []string{"192.0.2.1.", "2001:db8::1."} {
+		useReplay(t, replayed{
+			name:   "ip.example.com",
+			qtype:  dns.TypeCNAME,
+			answer: []string{"ip.example.com. 300 IN CNAME " + target},
+		})
+
+		rs := processDomain(context.Background(), job{domain: "ip.example.com", server: resolvers.pick()})
+		if len(rs) != 1 {
+			t.Fatalf("CNAME %s: got %d results, want 1: %+v", target, len(rs), rs)
+		}
+		if rs[0].Status != statusMalformedCNAMEIP {
+			t.Errorf("CNAME %s: status %q, want %q", target, rs[0].Status, statusMalformedCNAMEIP)
+		}
+	}
+}
+
+// TestNSTakeoverAlongsideCNAME checks the NS check of -ns-takeover, which
+// goes in config.extraTypes, doesn't take the place of the CNAME check.
+func TestNSTakeoverAlongsideCNAME(t *testing.T) {
+	useReplay(t,
+		replayed{name: "www.example.com", qtype: dns.TypeCNAME, answer: []string{"www.example.com. 60 IN CNAME live.example.net."}},
+		replayed{name: "live.example.net", qtype: dns.TypeA, answer: []string{"live.example.net. 60 IN A 192.0.2.10"}},
+		replayed{name: "live.example.net", qtype: dns.TypeAAAA},
+		replayed{name: "www.example.com", qtype: dns.TypeNS, answer: []string{"www.example.com. 60 IN NS ns1.gone.example.org."}},
+		replayed{name: "ns1.gone.example.org", qtype: dns.TypeA, rcode: dns.RcodeNameError},
+		replayed{name: "ns1.gone.example.org", qtype: dns.TypeAAAA, rcode: dns.RcodeNameError},
+	)
+	config.maxDepth = 1
+	config.nsTakeover = true
+	config.extraTypes = []uint16{dns.TypeNS}
+
+	rs := processDomain(context.Background(), job{domain: "www.example.com", server: resolvers.pick()})
+	if len(rs) != 2 {
+		t.Fatalf("got %d results, want 2: %+v", len(rs), rs)
+	}
+	if rs[0].Status != statusOK || rs[0].CNAME != "live.example.net" {
+		t.Errorf("CNAME: got %s %s, want %s live.example.net", rs[0].Status, rs[0].CNAME, statusOK)
+	}
+	if rs[1].Status != statusNSTakeover || rs[1].CNAME != "ns1.gone.example.org" || rs[1].RecordType != "NS" {
+		t.Errorf("NS: got %s %s %s, want %s ns1.gone.example.org NS", rs[1].Status, rs[1].CNAME, rs[1].RecordType, statusNSTakeover)
+	}
+}
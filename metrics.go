@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// resolverCounts is how many queries a resolver has been sent and how many
+// of them it failed.
+type resolverCounts struct {
+	queries, failures int64
+}
+
+// countQuery adds a query sent to server to the counters.
+func countQuery(server string, failed bool) {
+	stats.queries.Add(1)
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	if stats.resolvers == nil {
+		stats.resolvers = make(map[string]*resolverCounts)
+	}
+	c, ok := stats.resolvers[server]
+	if !ok {
+		c = &resolverCounts{}
+		stats.resolvers[server] = c
+	}
+	c.queries++
+	if failed {
+		c.failures++
+	}
+}
+
+// serveMetrics serves the run's counters in the Prometheus text format at
+// /metrics on addr until ctx is done.
+func serveMetrics(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+
+	go func() {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			slog.Error("metrics server failed", "err", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	return nil
+}
+
+// writeMetrics writes the counters to w in the Prometheus text format.
+func writeMetrics(w io.Writer) {
+	counter := func(name, help string, v int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	counter("check_cnames_domains_total", "Domains checked.", stats.domains.Load())
+	counter("check_cnames_queries_total", "DNS queries sent for domains' records.", stats.queries.Load())
+	counter("check_cnames_cnames_total", "Domains found to have a CNAME.", stats.cnames.Load())
+	counter("check_cnames_errors_total", "Domains whose lookups failed.", stats.errors.Load())
+	counter("check_cnames_dropped_total", "Results dropped because the printer couldn't keep up.", stats.dropped.Load())
+	counter("check_cnames_cache_hits_total", "Queries answered from the cache.", stats.cacheHits.Load())
+	counter("check_cnames_cache_misses_total", "Queries not found in the cache.", stats.cacheMisses.Load())
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	counter("check_cnames_dangling_total", "Dangling CNAMEs found.", countGroup(statusDangling))
+	counter("check_cnames_takeovers_total", "Possible takeovers found.", countGroup(statusTakeover))
+
+	fmt.Fprintf(w, "# HELP check_cnames_results_total Results by status.\n# TYPE check_cnames_results_total counter\n")
+	for _, s := range slices.Sorted(maps.Keys(stats.statuses)) {
+		fmt.Fprintf(w, "check_cnames_results_total{status=%q} %d\n", s, stats.statuses[s])
+	}
+
+	fmt.Fprintf(w, "# HELP check_cnames_resolver_queries_total DNS queries sent by resolver.\n# TYPE check_cnames_resolver_queries_total counter\n")
+	for _, r := range slices.Sorted(maps.Keys(stats.resolvers)) {
+		fmt.Fprintf(w, "check_cnames_resolver_queries_total{resolver=%q} %d\n", r, stats.resolvers[r].queries)
+	}
+	fmt.Fprintf(w, "# HELP check_cnames_resolver_failures_total DNS queries a resolver failed to answer.\n# TYPE check_cnames_resolver_failures_total counter\n")
+	for _, r := range slices.Sorted(maps.Keys(stats.resolvers)) {
+		fmt.Fprintf(w, "check_cnames_resolver_failures_total{resolver=%q} %d\n", r, stats.resolvers[r].failures)
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garmir/check-cnames/checkcname"
+)
+
+const (
+	statusOK       = checkcname.StatusOK
+	statusTakeover = checkcname.StatusTakeover
+	statusDangling = checkcname.StatusDangling
+	statusService  = checkcname.StatusService
+
+	statusNeedsConfirmation = checkcname.StatusNeedsConfirmation
+
+	statusDanglingPartial   = "dangling-partial"
+	statusTransportMismatch = "transport-mismatch"
+	statusSuspiciousLength  = "suspicious-length"
+	statusDelegationBroken  = "delegation-broken"
+	statusCloaking          = "cloaking"
+	statusHomoglyph         = "homoglyph"
+	statusMalformedCNAMEIP  = "malformed-cname-ip"
+	statusWildcard          = "wildcard"
+	statusNSTakeover        = "ns-takeover"
+	// statusLookupError is a target whose addresses couldn't be looked up,
+	// so there's no telling whether it's dangling
+	statusLookupError = "lookup-error"
+
+	// statusCNAME is a target that wasn't checked at all, with -cname-only
+	statusCNAME = "cname"
+)
+
+// statusGroup returns the status that status is counted and routed as: the
+// summary, -fail-on and the per-status files take every kind of takeover
+// for a takeover and every kind of dangling target for dangling.
+func statusGroup(status string) string {
+	switch status {
+	case statusNSTakeover:
+		return statusTakeover
+	case statusDanglingPartial, statusNeedsConfirmation:
+		return statusDangling
+	}
+	return status
+}
+
+// Output formats for -o.
+const (
+	outputText      = "text"
+	outputJSON      = "json"
+	outputJSONArray = "json-array"
+	outputCSV       = "csv"
+)
+
+// csvFields are the columns of -o csv unless -output-only-fields says
+// otherwise.
+var csvFields = []string{"domain", "cname", "status", "service", "resolver"}
+
+// Result is a single finding for an input domain.
+type Result struct {
+	Domain   string `json:"domain"`
+	CNAME    string `json:"cname"`
+	Status   string `json:"status"`
+	Service  string `json:"service,omitempty"`
+	Resolver string `json:"resolver,omitempty"`
+
+	// RawCNAME is the target exactly as it appeared in the response; CNAME
+	// is normalized and is what all checks use
+	RawCNAME string `json:"raw_cname,omitempty"`
+
+	// RecordType is the type of the record pointing at CNAME when it isn't
+	// a CNAME record, or with -type ANY
+	RecordType string `json:"type,omitempty"`
+
+	// Chain is every CNAME target from Domain's own to CNAME, the last one,
+	// when there was a chain to follow
+	Chain []string `json:"chain,omitempty"`
+
+	// TTL is that of Domain's own CNAME record, when it was looked up
+	TTL *uint32 `json:"ttl,omitempty"`
+
+	// Addresses are what CNAME resolves to, with -show-ips
+	Addresses []string `json:"addresses,omitempty"`
+
+	// Confidence is how likely a takeover is to be real: high, medium or
+	// low
+	Confidence string `json:"confidence,omitempty"`
+
+	// Detail holds any extra, status-specific information
+	Detail string `json:"detail,omitempty"`
+
+	// Timestamp is when the result was determined
+	Timestamp time.Time `json:"timestamp"`
+
+	// Tags are the key=value pairs given with the domain in the input
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// confirm is set on results still waiting for confirmResults, guessed
+	// on those whose service was only matched to be confirmed, and
+	// fingerprinted on those an HTTP fingerprint confirmed
+	confirm, guessed, fingerprinted bool
+}
+
+func (r Result) String() string {
+	s := fmt.Sprintf("[%s] %s -> ", strings.ToUpper(r.Status), toUnicode(r.Domain))
+	if r.Status == statusCNAME {
+		s = toUnicode(r.Domain) + " -> "
+	}
+	if config.verbose && len(r.Chain) > 1 {
+		for _, c := range r.Chain[:len(r.Chain)-1] {
+			s += toUnicode(c) + " -> "
+		}
+	}
+	if config.rawTarget {
+		s += r.target()
+	} else {
+		s += toUnicode(r.target())
+	}
+	if r.RecordType != "" {
+		s += fmt.Sprintf(" (%s record)", r.RecordType)
+	}
+	if config.verbose && r.TTL != nil {
+		s += fmt.Sprintf(" (ttl %d)", *r.TTL)
+	}
+	if len(r.Addresses) > 0 {
+		s += fmt.Sprintf(" (%s)", strings.Join(r.Addresses, ", "))
+	}
+	if r.Service != "" && r.Confidence != "" {
+		s += fmt.Sprintf(" (%s, %s confidence)", r.Service, r.Confidence)
+	} else if r.Service != "" {
+		s += fmt.Sprintf(" (%s)", r.Service)
+	}
+	if r.Detail != "" {
+		s += fmt.Sprintf(" (%s)", r.Detail)
+	}
+	if config.showTags && len(r.Tags) > 0 {
+		s += fmt.Sprintf(" [%s]", formatTags(r.Tags))
+	}
+	return s
+}
+
+// target returns the CNAME target as it should be displayed.
+func (r Result) target() string {
+	if config.rawTarget && r.RawCNAME != "" {
+		return r.RawCNAME
+	}
+	return r.CNAME
+}
+
+var textFields = map[string]func(Result) string{
+	"domain":     func(r Result) string { return r.Domain },
+	"cname":      func(r Result) string { return r.target() },
+	"status":     func(r Result) string { return r.Status },
+	"service":    func(r Result) string { return r.Service },
+	"resolver":   func(r Result) string { return r.Resolver },
+	"detail":     func(r Result) string { return r.Detail },
+	"confidence": func(r Result) string { return r.Confidence },
+	"type":       func(r Result) string { return r.RecordType },
+	"ttl": func(r Result) string {
+		if r.TTL == nil {
+			return ""
+		}
+		return strconv.FormatUint(uint64(*r.TTL), 10)
+	},
+	"addresses": func(r Result) string {
+		return strings.Join(r.Addresses, ",")
+	},
+	"timestamp": func(r Result) string {
+		return r.Timestamp.Format(time.RFC3339)
+	},
+	"tags": func(r Result) string { return formatTags(r.Tags) },
+}
+
+// parseFields validates a comma-separated list of text output columns.
+func parseFields(list string) ([]string, error) {
+	var fields []string
+	for _, f := range strings.Split(list, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f == "" {
+			continue
+		}
+		if _, ok := textFields[f]; !ok {
+			return nil, fmt.Errorf("unknown output field %q", f)
+		}
+		fields = append(fields, f)
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no output fields given")
+	}
+	return fields, nil
+}
+
+// formatResult renders r as a single line in the config.output format.
+func formatResult(r Result) string {
+	if config.output == outputJSON || config.output == outputJSONArray {
+		b, err := json.Marshal(r)
+		if err != nil {
+			// nothing in a Result can fail to marshal
+			panic(err)
+		}
+		return string(b)
+	}
+	if config.output == outputCSV {
+		return formatCSV(r, columns())
+	}
+	return formatText(r, config.fields)
+}
+
+// columns returns the CSV columns in use.
+func columns() []string {
+	if len(config.fields) > 0 {
+		return config.fields
+	}
+	return csvFields
+}
+
+// formatCSV renders r as a CSV record of fields, without the line ending.
+func formatCSV(r Result, fields []string) string {
+	cols := make([]string, len(fields))
+	for i, f := range fields {
+		cols[i] = textFields[f](r)
+	}
+	return csvRecord(cols)
+}
+
+func csvRecord(cols []string) string {
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	w.Write(cols)
+	w.Flush()
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// formatText renders r as a line of plain text; either the usual
+// human-readable form or, when fields are given, just those columns
+// separated by tabs.
+func formatText(r Result, fields []string) string {
+	if len(fields) == 0 {
+		if config.timestamps {
+			return r.Timestamp.Format(time.RFC3339) + " " + r.String()
+		}
+		return r.String()
+	}
+
+	cols := make([]string, len(fields))
+	for i, f := range fields {
+		cols[i] = textFields[f](r)
+	}
+	return strings.Join(cols, "\t")
+}
+
+// statusFile is a file that results of a single status are copied to.
+type statusFile struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+// openStatusFiles creates the per-status files from config.statusFiles.
+// They're owned by the printer from then on.
+func openStatusFiles() (map[string]*statusFile, error) {
+	files := make(map[string]*statusFile)
+	for status, path := range config.statusFiles {
+		sf, err := createStatusFile(path)
+		if err != nil {
+			return nil, err
+		}
+		files[status] = sf
+	}
+	return files, nil
+}
+
+func (sf *statusFile) close() error {
+	err := sf.w.Flush()
+	if cerr := sf.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func createStatusFile(path string) (*statusFile, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &statusFile{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// printer owns stdout (or the -out file), the per-status files and the
+// end-of-run reports; everything is written from the single goroutine
+// running printResults.
+type printer struct {
+	out   *statusFile
+	files map[string]*statusFile
+
+	// printed counts the results written to out, for separating the
+	// elements of a JSON array
+	printed int
+	index   targetIndex
+	sarif   *sarifReport
+	graph   *cnameGraph
+}
+
+// printResults writes every result to out, or stdout if it's nil, and to
+// its per-status file, and writes the end-of-run reports once results is
+// closed.
+//
+// With config.outputInterval the reports not on stdout are also rewritten
+// with what has been collected so far, and the per-status files flushed,
+// every interval; each snapshot is complete as of when it was written but
+// later snapshots can reorder what earlier ones contained.
+func printResults(results <-chan Result, out *statusFile, files map[string]*statusFile) {
+	p := &printer{
+		out:   out,
+		files: files,
+		index: targetIndex{},
+		sarif: newSarifReport(),
+		graph: newCNAMEGraph(),
+	}
+
+	if config.output == outputCSV {
+		header := csvRecord(columns()) + "\n"
+		p.write(header)
+		for _, sf := range files {
+			sf.w.WriteString(header)
+		}
+	}
+
+	var tick <-chan time.Time
+	if config.outputInterval > 0 {
+		t := time.NewTicker(config.outputInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	for {
+		select {
+		case r, ok := <-results:
+			if !ok {
+				p.close()
+				return
+			}
+			p.print(r)
+
+		case <-tick:
+			p.flush()
+			p.writeReports(false)
+		}
+	}
+}
+
+func (p *printer) print(r Result) {
+	if config.indexFile != "" {
+		p.index.add(r)
+	}
+	if config.sarifFile != "" {
+		p.sarif.add(r)
+	}
+	if config.dotFile != "" {
+		p.graph.add(r)
+	}
+
+	line := formatResult(r)
+	if sf, ok := p.files[statusGroup(r.Status)]; ok {
+		fmt.Fprintln(sf.w, line)
+	}
+	if r.Status == statusOK && !config.verbose {
+		return
+	}
+	if config.takeoverOnly && r.Status != statusTakeover && r.Status != statusNSTakeover {
+		return
+	}
+
+	// a JSON array is streamed out element by element rather than held
+	// back until the end, so it's only valid once close has run
+	if config.output == outputJSONArray {
+		if p.printed == 0 {
+			line = "[\n" + line
+		} else {
+			line = ",\n" + line
+		}
+		p.write(line)
+	} else {
+		p.write(line + "\n")
+	}
+	p.printed++
+}
+
+// write writes s to out, or stdout if there's no -out file.
+func (p *printer) write(s string) {
+	if p.out != nil {
+		p.out.w.WriteString(s)
+		return
+	}
+	os.Stdout.WriteString(s)
+}
+
+func (p *printer) flush() {
+	if p.out != nil {
+		if err := p.out.w.Flush(); err != nil {
+			slog.Error("failed to write output file", "err", err)
+		}
+	}
+	for status, sf := range p.files {
+		if err := sf.w.Flush(); err != nil {
+			slog.Error("failed to write status file", "status", status, "err", err)
+		}
+	}
+}
+
+// writeReports writes the reports asked for with what has been collected
+// so far. Unless final, ones going to stdout are left for the end; rewritten
+// every -output-interval they'd end up in the middle of the results.
+func (p *printer) writeReports(final bool) {
+	want := func(path string) bool {
+		return path != "" && (final || path != "-")
+	}
+
+	if want(config.indexFile) {
+		if err := p.index.write(config.indexFile); err != nil {
+			slog.Error("failed to write target index", "err", err)
+		}
+	}
+	if want(config.sarifFile) {
+		if err := p.sarif.write(config.sarifFile); err != nil {
+			slog.Error("failed to write SARIF log", "err", err)
+		}
+	}
+	if want(config.dotFile) {
+		if err := p.graph.write(config.dotFile); err != nil {
+			slog.Error("failed to write DOT graph", "err", err)
+		}
+	}
+	if want(config.serviceReport) {
+		if err := serviceCounts.write(config.serviceReport); err != nil {
+			slog.Error("failed to write service report", "err", err)
+		}
+	}
+}
+
+// close finishes off the output and writes the end-of-run reports. It runs
+// however the run ends, since an interrupt and -max-duration only stop the
+// input and cut the lookups in flight short, and results is still closed
+// once the workers are done; a streamed JSON array is always terminated.
+func (p *printer) close() {
+	if config.output == outputJSONArray {
+		if p.printed == 0 {
+			p.write("[]\n")
+		} else {
+			p.write("\n]\n")
+		}
+	}
+
+	if p.out != nil {
+		if err := p.out.close(); err != nil {
+			slog.Error("failed to write output file", "err", err)
+		}
+	}
+	for status, sf := range p.files {
+		if err := sf.close(); err != nil {
+			slog.Error("failed to write status file", "status", status, "err", err)
+		}
+	}
+	p.writeReports(true)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJSONArrayOutput(t *testing.T) {
+	saved := config.output
+	config.output = outputJSONArray
+	defer func() { config.output = saved }()
+
+	for _, rs := range [][]Result{
+		nil,
+		{{Domain: "a.example.com", CNAME: "gone.s3.amazonaws.com", Status: statusTakeover, Service: "AWS S3"}},
+		{
+			{Domain: "a.example.com", CNAME: "gone.s3.amazonaws.com", Status: statusTakeover, Service: "AWS S3"},
+			{Domain: "b.example.com", CNAME: "gone.example.net", Status: statusDangling},
+		},
+	} {
+		path := filepath.Join(t.TempDir(), "out.json")
+		out, err := createStatusFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		results := make(chan Result, len(rs))
+		for _, r := range rs {
+			results <- r
+		}
+		close(results)
+		printResults(results, out, nil)
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []Result
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatalf("%d results: invalid array %q: %v", len(rs), data, err)
+		}
+		if len(got) != len(rs) {
+			t.Errorf("got %d elements, want %d", len(got), len(rs))
+		}
+	}
+}
+
+// TestIntervalReportsSkipStdout checks that reports going to stdout are only
+// written at the end, not mixed in with the results every interval.
+func TestIntervalReportsSkipStdout(t *testing.T) {
+	stdout, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedStdout, savedIndex := os.Stdout, config.indexFile
+	os.Stdout, config.indexFile = stdout, "-"
+	defer func() { os.Stdout, config.indexFile = savedStdout, savedIndex }()
+
+	p := &printer{index: targetIndex{"gone.example.net": {"a.example.com"}}}
+	for _, final := range []bool{false, true} {
+		p.writeReports(final)
+		fi, err := stdout.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if written := fi.Size() > 0; written != final {
+			t.Errorf("final %v: written to stdout %v, want %v", final, written, final)
+		}
+	}
+}
+
+// TestStatusFilesByGroup checks that every kind of takeover and dangling
+// target ends up in the file for its group.
+func TestStatusFilesByGroup(t *testing.T) {
+	dir := t.TempDir()
+	files := make(map[string]*statusFile)
+	for _, status := range []string{statusTakeover, statusDangling} {
+		sf, err := createStatusFile(filepath.Join(dir, status))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[status] = sf
+	}
+	out, err := createStatusFile(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs := []Result{
+		{Domain: "a.example.com", CNAME: "ns.gone.example", Status: statusNSTakeover},
+		{Domain: "b.example.com", CNAME: "gone.herokuapp.com", Status: statusNeedsConfirmation, Service: "Heroku"},
+		{Domain: "c.example.com", CNAME: "gone.example.net", Status: statusDanglingPartial},
+		{Domain: "d.example.com", CNAME: "live.example.net", Status: statusOK},
+	}
+	results := make(chan Result, len(rs))
+	for _, r := range rs {
+		results <- r
+	}
+	close(results)
+	printResults(results, out, files)
+
+	for status, want := range map[string][]string{
+		statusTakeover: {"a.example.com"},
+		statusDangling: {"b.example.com", "c.example.com"},
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, status))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) != len(want) {
+			t.Fatalf("%s file: got %q, want lines for %v", status, lines, want)
+		}
+		for i, domain := range want {
+			if !strings.Contains(lines[i], domain) {
+				t.Errorf("%s file line %d: got %q, want %s", status, i, lines[i], domain)
+			}
+		}
+	}
+}
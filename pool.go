@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// semaphore bounds the number of running workers. Unlike a buffered
+// channel its limit can be changed while jobs are in flight.
+type semaphore struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+}
+
+func newSemaphore(limit int) *semaphore {
+	if limit < 1 {
+		limit = 1
+	}
+	s := &semaphore{limit: limit}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *semaphore) acquire() {
+	s.mu.Lock()
+	for s.active >= s.limit {
+		s.cond.Wait()
+	}
+	s.active++
+	s.mu.Unlock()
+}
+
+func (s *semaphore) release() {
+	s.mu.Lock()
+	s.active--
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// setLimit changes the number of workers allowed to run at once. Shrinking
+// doesn't interrupt running workers; new ones just wait until enough finish.
+func (s *semaphore) setLimit(limit int) {
+	if limit < 1 {
+		limit = 1
+	}
+	s.mu.Lock()
+	s.limit = limit
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+const (
+	// adaptiveStart is the number of workers -adaptive starts with.
+	adaptiveStart = 4
+	// adaptiveMinSamples is how many lookups an interval needs before its
+	// error rate is judged.
+	adaptiveMinSamples = 10
+	// adaptiveBackOffRate is the error rate above which the number of
+	// workers is halved, and adaptiveGrowRate the one below which it's
+	// raised by a quarter.
+	adaptiveBackOffRate = 0.1
+	adaptiveGrowRate    = 0.02
+)
+
+// adaptConcurrency starts sem off with a few workers and every interval
+// adjusts the number towards max while few lookups fail, or halves it when
+// too many do; timeouts under too much concurrency otherwise feed on
+// themselves.
+func adaptConcurrency(sem *semaphore, max int, every time.Duration) {
+	limit := adaptiveStart
+	if limit > max {
+		limit = max
+	}
+	sem.setLimit(limit)
+
+	go func() {
+		lastProcessed, lastErrors := stats.processed.Load(), stats.errors.Load()
+		for range time.Tick(every) {
+			processed, errs := stats.processed.Load(), stats.errors.Load()
+			n, failed := processed-lastProcessed, errs-lastErrors
+			if n < adaptiveMinSamples {
+				continue
+			}
+			lastProcessed, lastErrors = processed, errs
+
+			next := limit
+			switch rate := float64(failed) / float64(n); {
+			case rate > adaptiveBackOffRate:
+				next = limit / 2
+			case rate < adaptiveGrowRate:
+				next = limit + (limit+3)/4
+			}
+			if next > max {
+				next = max
+			}
+			if next < 1 {
+				next = 1
+			}
+			if next != limit {
+				limit = next
+				sem.setLimit(limit)
+				slog.Debug("concurrency adapted", "workers", limit, "failed", failed, "of", n)
+			}
+		}
+	}()
+}
+
+// reloadConcurrencyOnHUP re-reads the worker count from path whenever the
+// process receives SIGHUP and applies it to sem.
+func reloadConcurrencyOnHUP(path string, sem *semaphore) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			n, err := readConcurrency(path)
+			if err != nil {
+				slog.Error("failed to reload concurrency", "err", err)
+				continue
+			}
+			sem.setLimit(n)
+			slog.Info("concurrency set", "workers", n)
+		}
+	}()
+}
+
+func readConcurrency(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid concurrency in %s: %w", path, err)
+	}
+	if n < 1 {
+		return 0, fmt.Errorf("concurrency in %s must be at least 1", path)
+	}
+	return n, nil
+}
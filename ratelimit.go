@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// throttleStartRate is the rate a resolver without a configured limit
+	// is dropped to when it first signals it is rate limiting us.
+	throttleStartRate = 20.0
+	throttleMinRate   = 1.0
+	// throttleBurst is the number of back-to-back REFUSED responses that
+	// count as a rate limiting signal.
+	throttleBurst = 3
+	// throttleRecoverAfter is the number of successful responses after
+	// which a throttled rate is raised again, by throttleRecoverStep.
+	throttleRecoverAfter = 50
+	throttleRecoverStep  = 1.1
+	// throttleUnlimitedAt is the rate above which a resolver without a
+	// configured limit goes back to being unlimited.
+	throttleUnlimitedAt = 200.0
+)
+
+// resolverLimiter spaces out the queries sent to a single resolver, and
+// with config.throttleOnRateLimit adapts its rate to the resolver's own
+// backpressure.
+type resolverLimiter struct {
+	mu        sync.Mutex
+	base      float64
+	rate      float64
+	next      time.Time
+	refused   int
+	successes int
+}
+
+var (
+	limitersMu sync.Mutex
+	limiters   = make(map[string]*resolverLimiter)
+
+	// globalLimiter spaces out every query, retries included, across all
+	// resolvers to config.rate.
+	globalLimiter = &resolverLimiter{}
+)
+
+func newGlobalLimiter(rate float64) *resolverLimiter {
+	return &resolverLimiter{base: rate, rate: rate}
+}
+
+// limiterFor returns the limiter for the resolver at address, as it's
+// dialled.
+func limiterFor(address string) *resolverLimiter {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+
+	l, ok := limiters[address]
+	if !ok {
+		l = &resolverLimiter{base: config.resolverRate, rate: config.resolverRate}
+		limiters[address] = l
+	}
+	return l
+}
+
+// wait blocks until another query may be sent, or until ctx is done, in
+// which case it returns ctx's error. A rate of 0 is unlimited.
+func (l *resolverLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(time.Duration(float64(time.Second) / l.rate))
+	l.mu.Unlock()
+
+	t := time.NewTimer(time.Until(at))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitingExchanger holds every query back until globalLimiter and the
+// limiter of the resolver it goes to allow it, and feeds what comes back
+// into the latter. It sits below the cache, so that only queries that are
+// actually sent are limited and observed.
+type limitingExchanger struct {
+	exchanger
+}
+
+func (l limitingExchanger) Exchange(ctx context.Context, m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	limiter := limiterFor(address)
+	if err := globalLimiter.wait(ctx); err != nil {
+		return nil, 0, err
+	}
+	if err := limiter.wait(ctx); err != nil {
+		return nil, 0, err
+	}
+
+	r, rtt, err := l.exchanger.Exchange(ctx, m, address)
+	if err == nil {
+		limiter.observe(address, r)
+	}
+	return r, rtt, err
+}
+
+// rateLimitEDE are the Extended DNS Error codes (RFC 8914) resolvers
+// answer with when they won't resolve for us right now. Other counts only
+// when its text says it's about rate limiting.
+var rateLimitEDE = map[uint16]bool{
+	dns.ExtendedErrorCodeNotReady:   true,
+	dns.ExtendedErrorCodeProhibited: true,
+}
+
+// signalsRateLimit reports whether r carries an Extended DNS Error saying
+// the resolver is rate limiting us.
+func signalsRateLimit(r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		ede, ok := o.(*dns.EDNS0_EDE)
+		if !ok {
+			continue
+		}
+		if rateLimitEDE[ede.InfoCode] {
+			return true
+		}
+		text := strings.ToLower(ede.ExtraText)
+		if ede.InfoCode == dns.ExtendedErrorCodeOther && strings.Contains(text, "rate") && strings.Contains(text, "limit") {
+			return true
+		}
+	}
+	return false
+}
+
+// observe feeds the outcome of a query sent to server back into the
+// limiter. A burst of REFUSED responses, a truncated empty response (which
+// is what response rate limiting sends instead of dropping) or one with a
+// rate limiting Extended DNS Error halves the rate; a run of successes
+// raises it back gradually. Only responses that came from server count, not
+// ones from the cache.
+func (l *resolverLimiter) observe(server string, r *dns.Msg) {
+	if !config.throttleOnRateLimit {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limited := r.Truncated && len(r.Answer) == 0 || signalsRateLimit(r)
+	if r.Rcode == dns.RcodeRefused {
+		l.refused++
+		limited = limited || l.refused >= throttleBurst
+	} else {
+		l.refused = 0
+	}
+
+	if limited {
+		l.refused = 0
+		l.successes = 0
+		switch {
+		case l.rate <= 0:
+			l.rate = throttleStartRate
+		case l.rate/2 < throttleMinRate:
+			l.rate = throttleMinRate
+		default:
+			l.rate /= 2
+		}
+		slog.Debug("resolver is rate limiting, slowing down", "resolver", server, "rate", l.rate)
+		return
+	}
+
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return
+	}
+	if l.rate <= 0 || l.rate == l.base {
+		return
+	}
+
+	l.successes++
+	if l.successes < throttleRecoverAfter {
+		return
+	}
+	l.successes = 0
+	l.rate *= throttleRecoverStep
+
+	switch {
+	case l.base > 0 && l.rate > l.base:
+		l.rate = l.base
+	case l.base <= 0 && l.rate > throttleUnlimitedAt:
+		l.rate = 0
+	}
+}
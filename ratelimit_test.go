@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// edeExchanger answers every query with an address and an Extended DNS
+// Error of code, counting the queries it gets.
+type edeExchanger struct {
+	queries *int
+	code    uint16
+	text    string
+}
+
+func (e edeExchanger) Exchange(_ context.Context, m *dns.Msg, _ string) (*dns.Msg, time.Duration, error) {
+	*e.queries++
+	r := new(dns.Msg)
+	r.SetReply(m)
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   []byte{192, 0, 2, 1},
+	})
+	r.SetEdns0(dns.DefaultMsgSize, false)
+	opt := r.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: e.code, ExtraText: e.text})
+	return r, time.Millisecond, nil
+}
+
+func TestSignalsRateLimit(t *testing.T) {
+	for _, tt := range []struct {
+		code uint16
+		text string
+		want bool
+	}{
+		{dns.ExtendedErrorCodeNotReady, "", true},
+		{dns.ExtendedErrorCodeProhibited, "", true},
+		{dns.ExtendedErrorCodeOther, "ip-ratelimit exceeded", true},
+		{dns.ExtendedErrorCodeOther, "something else", false},
+		{dns.ExtendedErrorCodeStaleAnswer, "", false},
+	} {
+		var queries int
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.com.", dns.TypeA)
+		r, _, _ := edeExchanger{&queries, tt.code, tt.text}.Exchange(context.Background(), m, "")
+		if got := signalsRateLimit(r); got != tt.want {
+			t.Errorf("EDE %d %q: got %v, want %v", tt.code, tt.text, got, tt.want)
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	if signalsRateLimit(m) {
+		t.Error("a message without EDNS0 signals rate limiting")
+	}
+}
+
+// TestLimitingExchangerBelowCache checks that an answer from the cache
+// isn't fed into the resolver's limiter again.
+func TestLimitingExchangerBelowCache(t *testing.T) {
+	savedCache, savedThrottle := responseCache, config.throttleOnRateLimit
+	responseCache = newMemoryCache()
+	config.throttleOnRateLimit = true
+	const address = "192.0.2.99:53"
+	defer func() {
+		responseCache, config.throttleOnRateLimit = savedCache, savedThrottle
+		limitersMu.Lock()
+		delete(limiters, address)
+		limitersMu.Unlock()
+	}()
+
+	var queries int
+	c := cachingExchanger{limitingExchanger{edeExchanger{&queries, dns.ExtendedErrorCodeNotReady, ""}}}
+	for i := 0; i < 2; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.com.", dns.TypeA)
+		if _, _, err := c.Exchange(context.Background(), m, address); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if queries != 1 {
+		t.Fatalf("%d queries sent, want 1", queries)
+	}
+	if l := limiterFor(address); l.rate != throttleStartRate {
+		t.Errorf("rate %v, want %v after a single rate limited response", l.rate, throttleStartRate)
+	}
+}
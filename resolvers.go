@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	probeDomain  = "example.com."
+	probeCount   = 3
+	probeTimeout = 2 * time.Second
+)
+
+// resolvers is the pool every job picks its resolver from.
+var resolvers *resolverPool
+
+// Ways of picking a job's resolver for -resolver-strategy.
+const (
+	strategyRandom     = "random"
+	strategyRoundRobin = "round-robin"
+	strategySticky     = "sticky"
+)
+
+// parseStrategy checks that s is one of the resolver strategies.
+func parseStrategy(s string) (string, error) {
+	switch s = strings.ToLower(s); s {
+	case strategyRandom, strategyRoundRobin, strategySticky:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown resolver strategy %q", s)
+}
+
+// resolverPool hands out resolvers at random, optionally weighted so that
+// faster resolvers are picked more often, and leaving out ones that keep
+// failing for a while.
+type resolverPool struct {
+	mu      sync.RWMutex
+	servers []string
+	weights []float64
+	health  map[string]*resolverHealth
+
+	// next is the round-robin position
+	next atomic.Uint64
+}
+
+// resolverHealth is how a resolver in the pool has been doing lately.
+type resolverHealth struct {
+	failures     int
+	evictedUntil time.Time
+}
+
+func newResolverPool(servers []string) *resolverPool {
+	weights := make([]float64, len(servers))
+	health := make(map[string]*resolverHealth)
+	for i, s := range servers {
+		weights[i] = 1
+		health[s] = &resolverHealth{}
+	}
+	return &resolverPool{servers: servers, weights: weights, health: health}
+}
+
+// report records whether a query to server failed. After config.evictAfter
+// failures in a row server is left out of the rotation for
+// config.evictCooldown. Servers not in the pool are ignored.
+func (p *resolverPool) report(server string, failed bool) {
+	if config.evictAfter <= 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h, ok := p.health[server]
+	if !ok {
+		return
+	}
+	if !failed {
+		h.failures = 0
+		return
+	}
+	// still in use because everything else is evicted too
+	if time.Now().Before(h.evictedUntil) {
+		return
+	}
+	if h.failures++; h.failures >= config.evictAfter {
+		h.failures = 0
+		h.evictedUntil = time.Now().Add(config.evictCooldown)
+		slog.Info("evicting failing resolver", "resolver", server, "for", config.evictCooldown)
+	}
+}
+
+// parseResolvers validates resolver entries, each an IPv4 or IPv6 address
+// with an optional port (bracketed for IPv6, as in [2001:db8::1]:5353) or
+// a DNS over HTTPS URL, warning about and skipping any that aren't usable.
+// Addresses on port 53 are kept without it.
+func parseResolvers(entries []string) []string {
+	var servers []string
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "" || strings.HasPrefix(e, "#") {
+			continue
+		}
+		if isDoH(e) {
+			if _, err := url.Parse(e); err != nil {
+				slog.Warn("skipping resolver", "resolver", e, "err", err)
+				continue
+			}
+			servers = append(servers, e)
+			continue
+		}
+
+		host, port := strings.TrimSuffix(strings.TrimPrefix(e, "["), "]"), "53"
+		if h, p, err := net.SplitHostPort(e); err == nil {
+			host, port = h, p
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			slog.Warn("skipping resolver: not an IP address", "resolver", e)
+			continue
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			slog.Warn("skipping resolver: invalid port", "resolver", e)
+			continue
+		}
+
+		if port == "53" {
+			servers = append(servers, ip.String())
+		} else {
+			servers = append(servers, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	return servers
+}
+
+// readResolvers reads resolver entries from path, one per line.
+func readResolvers(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(b), "\n"), nil
+}
+
+func (p *resolverPool) all() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]string(nil), p.servers...)
+}
+
+func (p *resolverPool) pick() string {
+	return p.pickExcept("")
+}
+
+// pickFor picks the resolver for domain as config.resolverStrategy says:
+// at random, taking turns, or always the same one for the same domain.
+// Evicted resolvers are passed over for the next one in line.
+func (p *resolverPool) pickFor(domain string) string {
+	var start uint64
+	switch config.resolverStrategy {
+	case strategyRoundRobin:
+		start = p.next.Add(1) - 1
+	case strategySticky:
+		h := fnv.New64a()
+		h.Write([]byte(normalizeName(domain)))
+		start = h.Sum64()
+	default:
+		return p.pick()
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	n := uint64(len(p.servers))
+	now := time.Now()
+	for i := uint64(0); i < n; i++ {
+		if s := p.servers[(start+i)%n]; !now.Before(p.health[s].evictedUntil) {
+			return s
+		}
+	}
+	return p.servers[start%n]
+}
+
+// pickOther picks a resolver other than server, or returns an empty string
+// if there isn't one.
+func (p *resolverPool) pickOther(server string) string {
+	s := p.pickExcept(server)
+	if s == server {
+		return ""
+	}
+	return s
+}
+
+// pickN returns up to n different resolvers at random, starting with first
+// unless it's empty.
+func (p *resolverPool) pickN(first string, n int) []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var picked []string
+	if first != "" {
+		picked = append(picked, first)
+	}
+	for _, i := range rand.Perm(len(p.servers)) {
+		if len(picked) >= n {
+			break
+		}
+		if s := p.servers[i]; !slices.Contains(picked, s) {
+			picked = append(picked, s)
+		}
+	}
+	return picked
+}
+
+func (p *resolverPool) pickExcept(except string) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	// with every other resolver evicted, any of them beats none
+	now := time.Now()
+	usable := func(s string) bool {
+		return s != except && !now.Before(p.health[s].evictedUntil)
+	}
+	if !slices.ContainsFunc(p.servers, usable) {
+		usable = func(s string) bool { return s != except }
+	}
+
+	var total float64
+	for i, w := range p.weights {
+		if usable(p.servers[i]) {
+			total += w
+		}
+	}
+
+	n := rand.Float64() * total
+	last := ""
+	for i, w := range p.weights {
+		if !usable(p.servers[i]) {
+			continue
+		}
+		if n < w {
+			return p.servers[i]
+		}
+		n -= w
+		last = p.servers[i]
+	}
+	if last == "" {
+		return except
+	}
+	return last
+}
+
+// autoWeight probes the latency of every resolver now and then again every
+// interval, weighting each by the inverse of its latency. Slow resolvers
+// keep a small share of the queries rather than being dropped.
+func (p *resolverPool) autoWeight(interval time.Duration) {
+	p.probe()
+
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			p.probe()
+		}
+	}()
+}
+
+func (p *resolverPool) probe() {
+	p.mu.RLock()
+	servers := p.servers
+	p.mu.RUnlock()
+
+	latencies := make([]time.Duration, len(servers))
+	var wg sync.WaitGroup
+	for i, s := range servers {
+		wg.Add(1)
+		go func(i int, s string) {
+			defer wg.Done()
+			latencies[i] = probeLatency(s)
+		}(i, s)
+	}
+	wg.Wait()
+
+	weights := make([]float64, len(servers))
+	for i, l := range latencies {
+		if l < time.Millisecond {
+			l = time.Millisecond
+		}
+		weights[i] = 1 / l.Seconds()
+		slog.Debug("resolver latency", "resolver", servers[i], "latency", l)
+	}
+
+	p.mu.Lock()
+	p.weights = weights
+	p.mu.Unlock()
+}
+
+// probeLatency returns the average time server takes to answer a control
+// query, which is never answered from the cache. Failed probes count as the
+// probe timeout.
+func probeLatency(server string) time.Duration {
+	c, address := dial(server, "udp")
+	m := dns.Msg{}
+	m.SetQuestion(probeDomain, dns.TypeA)
+
+	var total time.Duration
+	for i := 0; i < probeCount; i++ {
+		ctx, cancel := context.WithTimeout(bypassCache(context.Background()), probeTimeout)
+		_, rtt, err := c.Exchange(ctx, &m, address)
+		cancel()
+		if err != nil {
+			rtt = probeTimeout
+		}
+		total += rtt
+	}
+	return total / probeCount
+}
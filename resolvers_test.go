@@ -0,0 +1,105 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseResolvers(t *testing.T) {
+	for _, tt := range []struct {
+		entry string
+		want  []string
+	}{
+		{"8.8.8.8", []string{"8.8.8.8"}},
+		{"8.8.8.8:53", []string{"8.8.8.8"}},
+		{"  8.8.8.8:5353 ", []string{"8.8.8.8:5353"}},
+		{"2001:db8::1", []string{"2001:db8::1"}},
+		{"[2001:db8::1]", []string{"2001:db8::1"}},
+		{"[2001:db8::1]:53", []string{"2001:db8::1"}},
+		{"[2001:db8::1]:5353", []string{"[2001:db8::1]:5353"}},
+		{"2001:0db8:0000::0001", []string{"2001:db8::1"}},
+		{"https://dns.example/dns-query", []string{"https://dns.example/dns-query"}},
+		{"", nil},
+		{"# a comment", nil},
+		{"dns.example", nil},
+		{"8.8.8.8:0", nil},
+		{"8.8.8.8:65536", nil},
+		{"8.8.8.8:dns", nil},
+		{"[2001:db8::1]:70000", nil},
+		// without brackets the last group is part of the address
+		{"2001:db8::1:5353", []string{"2001:db8::1:5353"}},
+	} {
+		if got := parseResolvers([]string{tt.entry}); !slices.Equal(got, tt.want) {
+			t.Errorf("parseResolvers(%q) = %q, want %q", tt.entry, got, tt.want)
+		}
+	}
+}
+
+func TestPickForSticky(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config.resolverStrategy = strategySticky
+	config.evictAfter = 1
+	config.evictCooldown = time.Minute
+
+	servers := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"}
+	p := newResolverPool(servers)
+	domains := []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com", "e.example.com", "f.example.com"}
+	picked := make(map[string]string)
+	used := make(map[string]bool)
+	for _, d := range domains {
+		picked[d] = p.pickFor(d)
+		used[picked[d]] = true
+	}
+	if len(used) < 2 {
+		t.Errorf("%d domains all went to %v", len(domains), used)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		pool   *resolverPool
+		domain func(string) string
+	}{
+		{"again", p, func(d string) string { return d }},
+		{"another pool", newResolverPool(slices.Clone(servers)), func(d string) string { return d }},
+		{"uppercase", p, strings.ToUpper},
+		{"trailing dot", p, func(d string) string { return d + "." }},
+	} {
+		for _, d := range domains {
+			if got := tt.pool.pickFor(tt.domain(d)); got != picked[d] {
+				t.Errorf("%s: %s went to %s, was %s", tt.name, tt.domain(d), got, picked[d])
+			}
+		}
+	}
+
+	// an evicted resolver's domains move on to the next one, and the rest
+	// stay where they were
+	evicted := picked[domains[0]]
+	p.report(evicted, true)
+	for _, d := range domains {
+		got := p.pickFor(d)
+		if got == evicted {
+			t.Errorf("%s still went to evicted %s", d, evicted)
+		} else if picked[d] != evicted && got != picked[d] {
+			t.Errorf("%s moved from %s to %s", d, picked[d], got)
+		}
+	}
+}
+
+func TestPickForRoundRobin(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config.resolverStrategy = strategyRoundRobin
+
+	servers := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}
+	p := newResolverPool(servers)
+	var got []string
+	for range 2 * len(servers) {
+		got = append(got, p.pickFor("www.example.com"))
+	}
+	if want := append(slices.Clone(servers), servers...); !slices.Equal(got, want) {
+		t.Errorf("picked %v, want %v", got, want)
+	}
+}
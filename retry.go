@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Error classes returned by classifyDNSError. A successful query, or one
+// that definitively says there's no CNAME, has no class.
+const (
+	errClassTimeout   = "timeout"
+	errClassServfail  = "servfail"
+	errClassRefused   = "refused"
+	errClassNXDomain  = "nxdomain"
+	errClassTruncated = "truncated"
+	errClassConn      = "connection"
+	errClassOther     = "other"
+)
+
+var errClasses = []string{
+	errClassTimeout,
+	errClassServfail,
+	errClassRefused,
+	errClassNXDomain,
+	errClassTruncated,
+	errClassConn,
+	errClassOther,
+}
+
+// classifyDNSError sorts the outcome of a query into one of the error
+// classes, given the error and the rcode of the response (-1 if none was
+// received).
+func classifyDNSError(err error, rcode int) string {
+	if errors.Is(err, errTruncated) {
+		return errClassTruncated
+	}
+
+	switch rcode {
+	case dns.RcodeSuccess:
+		if err == nil || errors.Is(err, errNoCNAME) {
+			return ""
+		}
+	case dns.RcodeServerFailure:
+		return errClassServfail
+	case dns.RcodeRefused:
+		return errClassRefused
+	case dns.RcodeNameError:
+		return errClassNXDomain
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return errClassTimeout
+	}
+	if isConnError(err) {
+		return errClassConn
+	}
+	if err != nil || rcode > 0 {
+		return errClassOther
+	}
+	return ""
+}
+
+// isConnError reports whether err is a transient problem with the local
+// socket or network path rather than anything the resolver said; e.g. a
+// "connection refused" on UDP caused by an ICMP port unreachable.
+func isConnError(err error) bool {
+	for _, errno := range []syscall.Errno{
+		syscall.ECONNREFUSED,
+		syscall.ECONNRESET,
+		syscall.EAGAIN,
+		syscall.ENETUNREACH,
+		syscall.EHOSTUNREACH,
+	} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolverFailed reports whether an error of class is the resolver's
+// failing rather than an answer about the name asked.
+func resolverFailed(class string) bool {
+	switch class {
+	case errClassTimeout, errClassConn, errClassServfail, errClassRefused:
+		return true
+	}
+	return false
+}
+
+// parseErrorClasses turns a comma-separated list of error classes into a set.
+func parseErrorClasses(list string) (map[string]bool, error) {
+	set := make(map[string]bool)
+	for _, c := range strings.Split(list, ",") {
+		c = strings.ToLower(strings.TrimSpace(c))
+		if c == "" {
+			continue
+		}
+
+		known := false
+		for _, k := range errClasses {
+			if c == k {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown error class %q", c)
+		}
+		set[c] = true
+	}
+	return set, nil
+}
+
+// backoff returns how long to wait before retry n (from 1): a random time
+// up to config.retryBase doubled for every earlier retry, capped at
+// config.retryCap, so that workers failing together don't all retry
+// together too.
+func backoff(n int) time.Duration {
+	d := config.retryBase
+	for i := 1; i < n && d < config.retryCap; i++ {
+		d *= 2
+	}
+	if d > config.retryCap {
+		d = config.retryCap
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// retriesTaken counts the retries made so far against
+// config.maxRetriesTotal.
+var (
+	retriesTaken   atomic.Int64
+	budgetSpentLog sync.Once
+)
+
+// takeRetry reports whether the run-wide retry budget allows another retry,
+// using one up if so. Without config.maxRetriesTotal there's no limit.
+func takeRetry() bool {
+	if config.maxRetriesTotal <= 0 {
+		return true
+	}
+	if retriesTaken.Add(1) <= config.maxRetriesTotal {
+		return true
+	}
+	budgetSpentLog.Do(func() {
+		slog.Warn("retry budget used up, not retrying for the rest of the run", "retries", config.maxRetriesTotal)
+	})
+	return false
+}
+
+// getCNAMEWithRetry calls getCNAME, retrying up to config.retries times
+// while the failure falls into one of the config.retryOn classes. Every
+// attempt uses a new client, and so a fresh socket, so connection-level
+// errors aren't repeated just because a socket went bad, and each retry
+// goes to a different resolver from the pool so that a single flaky one
+// doesn't fail every attempt, unless config.resolverStrategy is sticky.
+// Retrying stops once the run has made config.maxRetriesTotal retries, or
+// early once ctx is done. The result's server is the resolver that gave it.
+func getCNAMEWithRetry(ctx context.Context, domain, server string) (cnameResult, error) {
+	return withRetry(ctx, domain, server, func(server string) (cnameResult, error) {
+		return getCNAME(ctx, domain, server)
+	})
+}
+
+// getRecordsWithRetry is getCNAMEWithRetry for a query of type qtype.
+func getRecordsWithRetry(ctx context.Context, domain, server string, qtype uint16) (cnameResult, error) {
+	network := "udp"
+	if config.tcp {
+		network = "tcp"
+	}
+	return withRetry(ctx, domain, server, func(server string) (cnameResult, error) {
+		return queryRecords(ctx, domain, server, network, qtype, nil)
+	})
+}
+
+// withRetry makes the query for domain done by query against server with
+// the retries described at getCNAMEWithRetry.
+func withRetry(ctx context.Context, domain, server string, query func(server string) (cnameResult, error)) (cnameResult, error) {
+	var res cnameResult
+	var err error
+
+	for i := 0; i <= config.retries; i++ {
+		if i > 0 && ctx.Err() != nil {
+			break
+		}
+		if i > 0 {
+			select {
+			case <-time.After(backoff(i)):
+			case <-ctx.Done():
+				return res, err
+			}
+
+			// an authoritative nameserver can't be swapped for a resolver,
+			// and sticky domains keep theirs
+			if !isAuthoritativeServer(server) && config.resolverStrategy != strategySticky {
+				if other := resolvers.pickOther(server); other != "" {
+					server = other
+				}
+			}
+		}
+
+		res, err = query(server)
+		res.server = server
+		class := classifyDNSError(err, res.rcode)
+		resolvers.report(server, resolverFailed(class))
+		countQuery(server, resolverFailed(class))
+		if !config.retryOn[class] {
+			break
+		}
+		if i < config.retries && !takeRetry() {
+			break
+		}
+		if i < config.retries {
+			slog.Debug("retrying", "domain", domain, "resolver", server, "class", class, "err", err)
+		}
+	}
+	return res, err
+}
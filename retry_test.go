@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestClassifyDNSError(t *testing.T) {
+	refused := &net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("read", syscall.ECONNREFUSED)}
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	deadline := &net.OpError{Op: "read", Net: "udp", Err: os.ErrDeadlineExceeded}
+
+	for _, tt := range []struct {
+		name  string
+		err   error
+		rcode int
+		want  string
+	}{
+		{"success", nil, dns.RcodeSuccess, ""},
+		{"no cname", errNoCNAME, dns.RcodeSuccess, ""},
+		{"empty answer", errEmptyAnswer, dns.RcodeSuccess, ""},
+		{"nil without response", nil, -1, ""},
+		{"read timeout", deadline, -1, errClassTimeout},
+		{"context deadline", context.DeadlineExceeded, -1, errClassTimeout},
+		{"wrapped timeout", fmt.Errorf("exchange: %w", deadline), -1, errClassTimeout},
+		{"servfail", errServfail, dns.RcodeServerFailure, errClassServfail},
+		{"refused", errRefused, dns.RcodeRefused, errClassRefused},
+		{"nxdomain", errNXDomain, dns.RcodeNameError, errClassNXDomain},
+		{"truncated", errTruncated, dns.RcodeSuccess, errClassTruncated},
+		{"connection refused", refused, -1, errClassConn},
+		{"connection reset", reset, -1, errClassConn},
+		{"other error", errors.New("bad packet"), -1, errClassOther},
+		{"other rcode", nil, dns.RcodeNotImplemented, errClassOther},
+	} {
+		if got := classifyDNSError(tt.err, tt.rcode); got != tt.want {
+			t.Errorf("%s: classifyDNSError(%v, %d) = %q, want %q", tt.name, tt.err, tt.rcode, got, tt.want)
+		}
+	}
+}
+
+// closedPort returns an address on the loopback interface that nothing is
+// listening on for network.
+func closedPort(t *testing.T, network string) string {
+	t.Helper()
+	var addr string
+	switch network {
+	case "udp":
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = c.LocalAddr().String()
+		c.Close()
+	default:
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = l.Addr().String()
+		l.Close()
+	}
+	return addr
+}
+
+func TestConnectionRefused(t *testing.T) {
+	for _, network := range []string{"udp", "tcp"} {
+		c := dnsClient{&dns.Client{Net: network, Timeout: 2 * time.Second}}
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeCNAME)
+
+		_, _, err := c.Exchange(context.Background(), m, closedPort(t, network))
+		if err == nil {
+			t.Errorf("%s: exchange with a closed port succeeded", network)
+			continue
+		}
+		if !isConnError(err) {
+			t.Errorf("%s: isConnError(%v) = false", network, err)
+		}
+		if class := classifyDNSError(err, -1); class != errClassConn {
+			t.Errorf("%s: classifyDNSError(%v) = %q, want %q", network, err, class, errClassConn)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	for _, tt := range []struct {
+		base, cap time.Duration
+		n         int
+		max       time.Duration
+	}{
+		{100 * time.Millisecond, 2 * time.Second, 1, 100 * time.Millisecond},
+		{100 * time.Millisecond, 2 * time.Second, 2, 200 * time.Millisecond},
+		{100 * time.Millisecond, 2 * time.Second, 4, 800 * time.Millisecond},
+		{100 * time.Millisecond, 2 * time.Second, 5, 1600 * time.Millisecond},
+		{100 * time.Millisecond, 2 * time.Second, 6, 2 * time.Second},
+		{100 * time.Millisecond, 2 * time.Second, 1000, 2 * time.Second},
+		{time.Second, 500 * time.Millisecond, 1, 500 * time.Millisecond},
+		{0, 2 * time.Second, 3, 0},
+		{100 * time.Millisecond, 0, 3, 0},
+	} {
+		config.retryBase, config.retryCap = tt.base, tt.cap
+		var longest time.Duration
+		for range 1000 {
+			d := backoff(tt.n)
+			if d < 0 || d > tt.max {
+				t.Errorf("base %v cap %v: retry %d waits %v, want at most %v", tt.base, tt.cap, tt.n, d, tt.max)
+				break
+			}
+			longest = max(longest, d)
+		}
+		// the waits are spread over the whole range, not bunched at its
+		// start
+		if longest < tt.max/2 {
+			t.Errorf("base %v cap %v: retry %d waited at most %v of up to %v", tt.base, tt.cap, tt.n, longest, tt.max)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The subset of SARIF 2.1.0 needed to report findings.
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID                   string             `json:"id"`
+	ShortDescription     sarifMessage       `json:"shortDescription"`
+	DefaultConfiguration sarifConfiguration `json:"defaultConfiguration"`
+}
+
+type sarifConfiguration struct {
+	Level string `json:"level"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	LogicalLocations []sarifLogicalLocation `json:"logicalLocations"`
+}
+
+type sarifLogicalLocation struct {
+	FullyQualifiedName string `json:"fullyQualifiedName"`
+	Kind               string `json:"kind"`
+}
+
+// sarifReport collects findings to be written as a SARIF log at the end of
+// the run. Like targetIndex it's only used by the printer.
+type sarifReport struct {
+	rules   map[string]sarifRule
+	results []sarifResult
+}
+
+func newSarifReport() *sarifReport {
+	return &sarifReport{rules: make(map[string]sarifRule)}
+}
+
+func (s *sarifReport) add(r Result) {
+	if r.Status == statusOK {
+		return
+	}
+
+	id := r.Status
+	desc := fmt.Sprintf("CNAME status %s", r.Status)
+	if r.Service != "" {
+		id += "/" + slug(r.Service)
+		desc += " on " + r.Service
+	}
+
+	level := sarifLevel(r.Status)
+	if _, ok := s.rules[id]; !ok {
+		s.rules[id] = sarifRule{
+			ID:                   id,
+			ShortDescription:     sarifMessage{desc},
+			DefaultConfiguration: sarifConfiguration{level},
+		}
+	}
+
+	s.results = append(s.results, sarifResult{
+		RuleID:  id,
+		Level:   level,
+		Message: sarifMessage{r.String()},
+		Locations: []sarifLocation{{
+			LogicalLocations: []sarifLogicalLocation{{
+				FullyQualifiedName: r.Domain,
+				Kind:               "resource",
+			}},
+		}},
+	})
+}
+
+func (s *sarifReport) write(path string) error {
+	rules := make([]sarifRule, 0, len(s.rules))
+	for _, r := range s.rules {
+		rules = append(rules, r)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].ID < rules[j].ID })
+
+	results := s.results
+	if results == nil {
+		results = []sarifResult{}
+	}
+
+	log := sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs: []sarifRun{{
+			Tool: sarifTool{sarifDriver{
+				Name:           "check-cnames",
+				InformationURI: "https://github.com/garmir/check-cnames",
+				Rules:          rules,
+			}},
+			Results: results,
+		}},
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(log)
+}
+
+func sarifLevel(status string) string {
+	switch status {
+	case statusTakeover, statusNSTakeover:
+		return "error"
+	case statusDangling, statusNeedsConfirmation:
+		return "warning"
+	}
+	return "note"
+}
+
+// slug turns a service name like "AWS S3" into "aws-s3".
+func slug(s string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !('a' <= r && r <= 'z' || '0' <= r && r <= '9')
+	}), "-")
+}
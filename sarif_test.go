@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSarifReport(t *testing.T) {
+	s := newSarifReport()
+	s.add(Result{Domain: "a.example.com", CNAME: "gone.s3.amazonaws.com", Status: statusTakeover, Service: "AWS S3"})
+	s.add(Result{Domain: "b.example.com", CNAME: "gone.example.net", Status: statusDangling})
+	s.add(Result{Domain: "c.example.com", CNAME: "www.example.net", Status: statusOK})
+
+	path := filepath.Join(t.TempDir(), "out.sarif")
+	if err := s.write(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var log struct {
+		Version string `json:"version"`
+		Schema  string `json:"$schema"`
+		Runs    []struct {
+			Tool *struct {
+				Driver *struct {
+					Name  string `json:"name"`
+					Rules []struct {
+						ID string `json:"id"`
+					} `json:"rules"`
+				} `json:"driver"`
+			} `json:"tool"`
+			Results []struct {
+				RuleID    string                `json:"ruleId"`
+				Level     string                `json:"level"`
+				Message   struct{ Text string } `json:"message"`
+				Locations []struct {
+					LogicalLocations []struct {
+						FullyQualifiedName string `json:"fullyQualifiedName"`
+					} `json:"logicalLocations"`
+				} `json:"locations"`
+			} `json:"results"`
+		} `json:"runs"`
+	}
+	if err := json.Unmarshal(data, &log); err != nil {
+		t.Fatal(err)
+	}
+
+	if log.Version != "2.1.0" {
+		t.Errorf("version = %q, want 2.1.0", log.Version)
+	}
+	if log.Schema == "" {
+		t.Error("no $schema")
+	}
+	if len(log.Runs) != 1 {
+		t.Fatalf("%d runs, want 1", len(log.Runs))
+	}
+	run := log.Runs[0]
+	if run.Tool == nil || run.Tool.Driver == nil || run.Tool.Driver.Name == "" {
+		t.Fatal("no runs[].tool.driver.name")
+	}
+
+	rules := make(map[string]bool)
+	for _, r := range run.Tool.Driver.Rules {
+		rules[r.ID] = true
+	}
+	want := []struct{ rule, level, domain string }{
+		{statusTakeover + "/aws-s3", "error", "a.example.com"},
+		{statusDangling, "warning", "b.example.com"},
+	}
+	if len(run.Results) != len(want) {
+		t.Fatalf("%d results, want %d", len(run.Results), len(want))
+	}
+	for i, w := range want {
+		r := run.Results[i]
+		if r.RuleID != w.rule || r.Level != w.level {
+			t.Errorf("result %d: rule %q level %q, want %q %q", i, r.RuleID, r.Level, w.rule, w.level)
+		}
+		if !rules[r.RuleID] {
+			t.Errorf("result %d: rule %q isn't in the driver's rules", i, r.RuleID)
+		}
+		if r.Message.Text == "" {
+			t.Errorf("result %d: no message", i)
+		}
+		if len(r.Locations) == 0 || len(r.Locations[0].LogicalLocations) == 0 ||
+			r.Locations[0].LogicalLocations[0].FullyQualifiedName != w.domain {
+			t.Errorf("result %d: locations %+v, want %s", i, r.Locations, w.domain)
+		}
+	}
+}
+
+// requireProperties fails t for each of props missing from obj, which
+// where names in the log. Properties that are present but null count as
+// missing, as the schema doesn't allow null for any of them.
+func requireProperties(t *testing.T, where string, obj map[string]any, props ...string) {
+	t.Helper()
+	for _, p := range props {
+		if obj[p] == nil {
+			t.Errorf("%s: no %s", where, p)
+		}
+	}
+}
+
+// TestSarifRequiredProperties checks the log for the properties the SARIF
+// 2.1.0 schema requires, and those code scanning tools need on each result
+// to place and rank it, without going through the types that wrote it.
+func TestSarifRequiredProperties(t *testing.T) {
+	s := newSarifReport()
+	s.add(Result{Domain: "a.example.com", CNAME: "gone.s3.amazonaws.com", Status: statusTakeover, Service: "AWS S3"})
+	s.add(Result{Domain: "b.example.com", CNAME: "gone.example.net", Status: statusDangling})
+	s.add(Result{Domain: "c.example.com", CNAME: "ns.example.net", Status: statusNSTakeover})
+
+	path := filepath.Join(t.TempDir(), "out.sarif")
+	if err := s.write(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var log map[string]any
+	if err := json.Unmarshal(data, &log); err != nil {
+		t.Fatal(err)
+	}
+	requireProperties(t, "log", log, "version", "$schema", "runs")
+	runs, _ := log["runs"].([]any)
+	if len(runs) != 1 {
+		t.Fatalf("%d runs, want 1", len(runs))
+	}
+
+	run, _ := runs[0].(map[string]any)
+	requireProperties(t, "run", run, "tool", "results")
+	tool, _ := run["tool"].(map[string]any)
+	requireProperties(t, "tool", tool, "driver")
+	driver, _ := tool["driver"].(map[string]any)
+	requireProperties(t, "tool.driver", driver, "name", "rules")
+
+	rules := make(map[string]bool)
+	for i, r := range asSlice(driver["rules"]) {
+		rule, _ := r.(map[string]any)
+		requireProperties(t, fmt.Sprintf("rule %d", i), rule, "id")
+		id, _ := rule["id"].(string)
+		rules[id] = true
+	}
+
+	levels := map[string]bool{"none": true, "note": true, "warning": true, "error": true}
+	results := asSlice(run["results"])
+	if len(results) != 3 {
+		t.Fatalf("%d results, want 3", len(results))
+	}
+	for i, r := range results {
+		where := fmt.Sprintf("result %d", i)
+		result, _ := r.(map[string]any)
+		requireProperties(t, where, result, "ruleId", "level", "message", "locations")
+
+		if id, _ := result["ruleId"].(string); !rules[id] {
+			t.Errorf("%s: rule %q isn't in the driver's rules", where, id)
+		}
+		if level, _ := result["level"].(string); !levels[level] {
+			t.Errorf("%s: level %q isn't one the schema allows", where, level)
+		}
+		message, _ := result["message"].(map[string]any)
+		requireProperties(t, where+" message", message, "text")
+
+		locations := asSlice(result["locations"])
+		if len(locations) == 0 {
+			t.Errorf("%s: no locations", where)
+			continue
+		}
+		location, _ := locations[0].(map[string]any)
+		logical := asSlice(location["logicalLocations"])
+		if len(logical) == 0 {
+			t.Errorf("%s: no logicalLocations", where)
+			continue
+		}
+		l, _ := logical[0].(map[string]any)
+		requireProperties(t, where+" location", l, "fullyQualifiedName")
+	}
+}
+
+// asSlice returns v as a JSON array, or nil if it isn't one.
+func asSlice(v any) []any {
+	s, _ := v.([]any)
+	return s
+}
+
+func TestSarifReportEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.sarif")
+	if err := newSarifReport().write(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var log struct {
+		Runs []struct {
+			Results json.RawMessage `json:"results"`
+		} `json:"runs"`
+	}
+	if err := json.Unmarshal(data, &log); err != nil {
+		t.Fatal(err)
+	}
+	// results is required, so a clean run still has an empty array
+	if len(log.Runs) != 1 || string(log.Runs[0].Results) != "[]" {
+		t.Errorf("got %s, want one run with empty results", data)
+	}
+}
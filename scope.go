@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// parseScope turns apex domain entries into the suffixes -scope allows,
+// skipping blank lines and comments.
+func parseScope(entries []string) ([]string, error) {
+	var apexes []string
+	for _, e := range entries {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" || strings.HasPrefix(e, "#") {
+			continue
+		}
+		apex, err := toASCII(strings.Trim(e, "."))
+		if err != nil {
+			return nil, err
+		}
+		apexes = append(apexes, apex)
+	}
+	return apexes, nil
+}
+
+// readScope reads apex domains from path, one per line.
+func readScope(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(b), "\n"), nil
+}
+
+// inScope reports whether domain is one of config.scope's apexes or under
+// one; without a scope everything is.
+func inScope(domain string) bool {
+	if len(config.scope) == 0 {
+		return true
+	}
+	name := normalizeName(domain)
+	for _, apex := range config.scope {
+		if hasDomainSuffix(name, apex) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// serviceReport counts, per matched service, how many domains pointed at
+// it with a CNAME that doesn't resolve and how many of those are
+// takeovers. It's updated by the workers as domains are processed.
+type serviceReport struct {
+	mu       sync.Mutex
+	services map[string]*serviceCount
+}
+
+type serviceCount struct {
+	dangling, takeover int
+}
+
+var serviceCounts = &serviceReport{services: make(map[string]*serviceCount)}
+
+func (s *serviceReport) add(r Result) {
+	if r.Service == "" {
+		return
+	}
+	switch r.Status {
+	case statusTakeover, statusDangling, statusDanglingPartial, statusNeedsConfirmation:
+	default:
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.services[r.Service]
+	if !ok {
+		c = &serviceCount{}
+		s.services[r.Service] = c
+	}
+	c.dangling++
+	if r.Status == statusTakeover {
+		c.takeover++
+	}
+}
+
+// write stores the report in path, or on stdout if path is "-", one line
+// per service with the most dangling domains first.
+func (s *serviceReport) write(path string) error {
+	s.mu.Lock()
+	names := make([]string, 0, len(s.services))
+	counts := make(map[string]serviceCount, len(s.services))
+	for name, c := range s.services {
+		names = append(names, name)
+		counts[name] = *c
+	}
+	s.mu.Unlock()
+
+	sort.Slice(names, func(i, j int) bool {
+		a, b := counts[names[i]], counts[names[j]]
+		if a.dangling != b.dangling {
+			return a.dangling > b.dangling
+		}
+		return names[i] < names[j]
+	})
+
+	var out io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	for _, name := range names {
+		c := counts[name]
+		noun := "domains"
+		if c.dangling == 1 {
+			noun = "domain"
+		}
+		if _, err := fmt.Fprintf(out, "%d %s dangling on %s (%d takeoverable)\n", c.dangling, noun, name, c.takeover); err != nil {
+			return err
+		}
+	}
+	return nil
+}
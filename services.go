@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+
+	"github.com/garmir/check-cnames/checkcname"
+)
+
+type (
+	service   = checkcname.Service
+	httpProbe = checkcname.HTTPProbe
+)
+
+// cloudFront has its own verification logic; see verifyCloudFront.
+const cloudFront = checkcname.CloudFront
+
+// Ways a service's unclaimed targets are recognised; see checkcname.Detection.
+const (
+	detectNXDomain = checkcname.DetectNXDomain
+	detectHTTP     = checkcname.DetectHTTP
+	detectPattern  = checkcname.DetectPattern
+)
+
+var vulnerableServices = checkcname.DefaultServices()
+
+// checkVulnerableService returns the name of the service whose patterns
+// match target, or an empty string if there is none.
+func checkVulnerableService(target string) string {
+	return checkcname.MatchService(vulnerableServices, target)
+}
+
+// scoreResult sets the confidence of a takeover finding; see
+// checkcname.Service.TakeoverConfidence.
+func scoreResult(r *Result) {
+	if r.Status != statusTakeover || r.Service == "" {
+		return
+	}
+	s, _ := serviceByName(r.Service)
+	r.Confidence = string(s.TakeoverConfidence(r.fingerprinted))
+}
+
+// detectionOf returns how the service called name is detected.
+func detectionOf(name string) checkcname.Detection {
+	s, _ := serviceByName(name)
+	return s.Detects()
+}
+
+func serviceByName(name string) (service, bool) {
+	for _, s := range vulnerableServices {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return service{}, false
+}
+
+// checkServiceRanges returns the name of the first service whose address
+// ranges contain one of addrs, a target's addresses as resolves found them.
+func checkServiceRanges(addrs []string) string {
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			continue
+		}
+		for _, s := range vulnerableServices {
+			for _, r := range s.Ranges {
+				if r.Contains(ip) {
+					return s.Name
+				}
+			}
+		}
+	}
+	return ""
+}
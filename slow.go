@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Phases of checking a domain that are timed for -slow-threshold.
+const (
+	phaseQuery   = "query"
+	phaseResolve = "resolve"
+	phaseConfirm = "confirm"
+)
+
+// timings adds up how long each phase of checking a domain took.
+type timings struct {
+	mu     sync.Mutex
+	phases map[string]time.Duration
+}
+
+type timingsKey struct{}
+
+// withTimings returns a context that startPhase records timings in.
+func withTimings(ctx context.Context) (context.Context, *timings) {
+	t := &timings{phases: make(map[string]time.Duration)}
+	return withTimingsOf(ctx, t), t
+}
+
+// withTimingsOf returns a context that startPhase records timings in t,
+// for carrying on timing a domain under another context.
+func withTimingsOf(ctx context.Context, t *timings) context.Context {
+	return context.WithValue(ctx, timingsKey{}, t)
+}
+
+// startPhase starts timing phase, adding what it took to ctx's timings when
+// the returned function is called. Without timings in ctx nothing is timed.
+func startPhase(ctx context.Context, phase string) func() {
+	t, ok := ctx.Value(timingsKey{}).(*timings)
+	if !ok {
+		return func() {}
+	}
+
+	start := time.Now()
+	return func() {
+		t.mu.Lock()
+		t.phases[phase] += time.Since(start)
+		t.mu.Unlock()
+	}
+}
+
+// logSlow logs domain as slow if checking it took longer than
+// config.slowThreshold, with how long each phase took; anything that isn't
+// one of the timed phases counts as other.
+func (t *timings) logSlow(domain string, took time.Duration) {
+	if took <= config.slowThreshold {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	attrs := []any{"domain", domain, "took", took}
+	other := took
+	for _, p := range []string{phaseQuery, phaseResolve, phaseConfirm} {
+		attrs = append(attrs, p, t.phases[p])
+		other -= t.phases[p]
+	}
+	slog.Warn("slow domain", append(attrs, "other", other)...)
+}
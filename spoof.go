@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// checkTransports repeats the CNAME query for domain over DNS over TLS to the
+// same resolver and compares it with the answer already received over UDP.
+// A differing answer can point to something on the path tampering with
+// plain DNS. Both queries bypass the cache (checkDomain sees to the UDP
+// one), since a cached answer may have come from another resolver. The
+// second return value is false when the answers agree or either query
+// failed for reasons other than there being no CNAME.
+func checkTransports(ctx context.Context, domain, server, udpCNAME string, udpErr error) (Result, bool) {
+	if udpErr != nil && !errors.Is(udpErr, errNoCNAME) {
+		return Result{}, false
+	}
+
+	tlsRes, err := queryCNAME(bypassCache(ctx), domain, server, "tcp-tls")
+	if err != nil && !errors.Is(err, errNoCNAME) {
+		return Result{}, false
+	}
+
+	udpCNAME = strings.ToLower(strings.TrimSuffix(udpCNAME, "."))
+	tlsCNAME := strings.ToLower(strings.TrimSuffix(tlsRes.target, "."))
+	if udpCNAME == tlsCNAME {
+		return Result{}, false
+	}
+
+	return Result{
+		Domain:   domain,
+		CNAME:    orNone(udpCNAME),
+		Status:   statusTransportMismatch,
+		Detail:   "tls: " + orNone(tlsCNAME),
+		Resolver: server,
+	}, true
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
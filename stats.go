@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stats holds the run-wide counters.
+var stats struct {
+	dispatched atomic.Int64
+	domains    atomic.Int64
+	processed  atomic.Int64
+	cnames     atomic.Int64
+	errors     atomic.Int64
+	dropped    atomic.Int64
+	duplicates atomic.Int64
+	outOfScope atomic.Int64
+	coalesced  atomic.Int64
+	queries    atomic.Int64
+
+	cacheHits   atomic.Int64
+	cacheMisses atomic.Int64
+
+	mu        sync.Mutex
+	statuses  map[string]int64
+	resolvers map[string]*resolverCounts
+}
+
+// reportProgress writes how far along the run is to w every interval until
+// done is closed, and one last time then. The returned channel is closed
+// once that last line has been written.
+func reportProgress(w io.Writer, every time.Duration, done <-chan struct{}) <-chan struct{} {
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+
+		t := time.NewTicker(every)
+		defer t.Stop()
+
+		start := time.Now()
+		last, lastAt := int64(0), start
+		for {
+			select {
+			case now := <-t.C:
+				completed := stats.domains.Load()
+				rate := float64(completed-last) / now.Sub(lastAt).Seconds()
+				fmt.Fprintf(w, "progress: %d dispatched, %d completed, %.1f/s\n", stats.dispatched.Load(), completed, rate)
+				last, lastAt = completed, now
+
+			case <-done:
+				completed := stats.domains.Load()
+				rate := float64(completed) / time.Since(start).Seconds()
+				fmt.Fprintf(w, "progress: %d dispatched, %d completed, %.1f/s overall\n", stats.dispatched.Load(), completed, rate)
+				return
+			}
+		}
+	}()
+	return finished
+}
+
+// countResult adds r to the per-status counts.
+func countResult(r Result) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	if stats.statuses == nil {
+		stats.statuses = make(map[string]int64)
+	}
+	stats.statuses[r.Status]++
+}
+
+// countGroup returns the number of results counted whose statusGroup is
+// group. stats.mu must be held.
+func countGroup(group string) int64 {
+	var n int64
+	for s, c := range stats.statuses {
+		if statusGroup(s) == group {
+			n += c
+		}
+	}
+	return n
+}
+
+// writeSummary writes the end-of-run tally to w.
+func writeSummary(w io.Writer) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	fmt.Fprintf(w, "%d domains, %d CNAMEs, %d dangling, %d takeovers, %d errors\n",
+		stats.domains.Load(), stats.cnames.Load(),
+		countGroup(statusDangling), countGroup(statusTakeover), stats.errors.Load())
+
+	statuses := make([]string, 0, len(stats.statuses))
+	for s := range stats.statuses {
+		statuses = append(statuses, s)
+	}
+	sort.Strings(statuses)
+	for _, s := range statuses {
+		fmt.Fprintf(w, "  %s: %d\n", s, stats.statuses[s])
+	}
+	if n := stats.dropped.Load(); n > 0 {
+		fmt.Fprintf(w, "  dropped: %d\n", n)
+	}
+	if n := stats.duplicates.Load(); n > 0 {
+		fmt.Fprintf(w, "  duplicates skipped: %d\n", n)
+	}
+	if n := stats.coalesced.Load(); n > 0 {
+		fmt.Fprintf(w, "  lookups shared with -coalesce: %d\n", n)
+	}
+	if n := stats.outOfScope.Load(); n > 0 {
+		fmt.Fprintf(w, "  out of scope skipped: %d\n", n)
+	}
+	if hits, misses := stats.cacheHits.Load(), stats.cacheMisses.Load(); hits+misses > 0 {
+		fmt.Fprintf(w, "  cache: %d hits, %d misses\n", hits, misses)
+	}
+}
+
+// Exit codes for -fail-on.
+const (
+	exitTakeover = 2
+	exitDangling = 3
+)
+
+// findingsExitCode returns the exit code config.failOn calls for given the
+// results counted so far, or 0.
+func findingsExitCode() int {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	if config.failOn == "" {
+		return 0
+	}
+	if countGroup(statusTakeover) > 0 {
+		return exitTakeover
+	}
+	if config.failOn == statusDangling && countGroup(statusDangling) > 0 {
+		return exitDangling
+	}
+	return 0
+}
+
+// errorLimit is a threshold on the number of failed lookups, either as an
+// absolute count or as a fraction of those processed.
+type errorLimit struct {
+	count int64
+	rate  float64
+}
+
+// parseErrorLimit parses either a count ("100") or a percentage ("25%").
+func parseErrorLimit(s string) (errorLimit, error) {
+	if p, ok := strings.CutSuffix(s, "%"); ok {
+		rate, err := strconv.ParseFloat(p, 64)
+		if err != nil || rate <= 0 || rate > 100 {
+			return errorLimit{}, fmt.Errorf("invalid error rate %q", s)
+		}
+		return errorLimit{rate: rate / 100}, nil
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return errorLimit{}, fmt.Errorf("invalid error count %q", s)
+	}
+	return errorLimit{count: n}, nil
+}
+
+// exceeded reports whether the errors so far are over the limit. Rates are
+// only judged once at least min domains have been processed.
+func (l errorLimit) exceeded(min int64) bool {
+	errs := stats.errors.Load()
+	if l.count > 0 {
+		return errs >= l.count
+	}
+	if l.rate > 0 {
+		n := stats.processed.Load()
+		return n >= min && float64(errs)/float64(n) >= l.rate
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// splitTags separates the key=value tags from the tab-separated fields of
+// an input line, returning what's left of the line (domain names can't
+// contain "=") and the tags, if there are any. A field with a "/" or "?"
+// before the "=" is a URL with a query string rather than a tag.
+func splitTags(line string) (string, map[string]string) {
+	if !strings.Contains(line, "=") {
+		return line, nil
+	}
+
+	var rest []string
+	tags := make(map[string]string)
+	for _, f := range strings.Split(line, "\t") {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok || strings.ContainsAny(k, "/?") {
+			rest = append(rest, f)
+			continue
+		}
+		if k = strings.TrimSpace(k); k != "" {
+			tags[k] = strings.TrimSpace(v)
+		}
+	}
+	return strings.Join(rest, "\t"), tags
+}
+
+// formatTags renders tags as space-separated key=value pairs, sorted by key.
+func formatTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + tags[k]
+	}
+	return strings.Join(pairs, " ")
+}
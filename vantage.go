@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// resolvesVia reports whether name resolves according to the recursive
+// resolver server.
+func resolvesVia(ctx context.Context, name, server string) (bool, error) {
+	c, address := dial(server, "udp")
+	return resolvesWith(ctx, name, c, address)
+}
+
+// resolvesWith is resolvesVia for a resolver at address reached through c.
+func resolvesWith(ctx context.Context, name string, c exchanger, address string) (bool, error) {
+	addrs, err := addrsWith(ctx, name, c, address)
+	return familiesOf(addrs).resolves(), err
+}
+
+// addrsWith asks the resolver at address, reached through c, for the IPv4
+// and IPv6 addresses of name.
+func addrsWith(ctx context.Context, name string, c exchanger, address string) ([]string, error) {
+	var addrs []string
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(name), qtype)
+		m.RecursionDesired = true
+
+		r, _, err := c.Exchange(ctx, m, address)
+		if err != nil {
+			return nil, err
+		}
+		// a name that doesn't exist has no addresses, but a SERVFAIL
+		// doesn't tell either way
+		if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+			return nil, fmt.Errorf("%s for %s %s", dns.RcodeToString[r.Rcode], name, dns.TypeToString[qtype])
+		}
+		for _, ans := range r.Answer {
+			switch rr := ans.(type) {
+			case *dns.A:
+				addrs = append(addrs, rr.A.String())
+			case *dns.AAAA:
+				addrs = append(addrs, rr.AAAA.String())
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// countVantages asks every resolver in the pool whether name resolves and
+// returns how many said it doesn't out of how many were asked.
+func countVantages(ctx context.Context, name string) (dangling, asked int) {
+	servers := resolvers.all()
+	ctx = bypassCache(ctx)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s string) {
+			defer wg.Done()
+
+			ok, err := resolvesVia(ctx, name, s)
+			if err != nil || ok {
+				return
+			}
+			mu.Lock()
+			dangling++
+			mu.Unlock()
+		}(s)
+	}
+	wg.Wait()
+	return dangling, len(servers)
+}
+
+// checkConsensus asks config.consensus resolvers, starting with server,
+// whether a dangling result's target resolves, and downgrades it to partially
+// dangling unless most of them say it doesn't. Resolvers that don't answer
+// count against it.
+func checkConsensus(ctx context.Context, r *Result, server string) {
+	servers := resolvers.pickN(server, config.consensus)
+	ctx = bypassCache(ctx)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	dangling := 0
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s string) {
+			defer wg.Done()
+
+			ok, err := resolvesVia(ctx, r.CNAME, s)
+			if err != nil || ok {
+				return
+			}
+			mu.Lock()
+			dangling++
+			mu.Unlock()
+		}(s)
+	}
+	wg.Wait()
+
+	if 2*dangling > len(servers) {
+		return
+	}
+	r.Status = statusDanglingPartial
+	r.Detail = fmt.Sprintf("doesn't resolve via %d of %d resolvers", dangling, len(servers))
+}
+
+// checkVantages downgrades a dangling result to partially dangling unless
+// every resolver agrees its target doesn't resolve; the local view isn't
+// shared everywhere. Resolvers that don't answer count as disagreeing.
+func checkVantages(ctx context.Context, r *Result) {
+	dangling, asked := countVantages(ctx, r.CNAME)
+	if dangling == asked {
+		return
+	}
+
+	r.Status = statusDanglingPartial
+	r.Detail = fmt.Sprintf("doesn't resolve via %d of %d resolvers", dangling, asked)
+}
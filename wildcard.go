@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// wildcards caches, per parent name, whether it answers for any name
+// below it.
+var wildcards sync.Map
+
+// hasWildcard reports whether name's parent, which it also returns, answers
+// for a made-up name below it as well; if so, name resolving says nothing
+// about whether it was ever set up. Names directly below a public suffix
+// aren't checked.
+func hasWildcard(ctx context.Context, name string) (string, bool) {
+	_, parent, ok := strings.Cut(name, ".")
+	if !ok {
+		return "", false
+	}
+	if suffix, _ := publicsuffix.PublicSuffix(parent); suffix == parent {
+		return "", false
+	}
+
+	if v, ok := wildcards.Load(parent); ok {
+		return parent, v.(bool)
+	}
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	addrs, _ := resolves(ctx, hex.EncodeToString(b)+"."+parent)
+	wild := familiesOf(addrs).resolves()
+	if ctx.Err() == nil {
+		wildcards.Store(parent, wild)
+	}
+	return parent, wild
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// zoneOf returns the registrable domain (eTLD+1) for domain, or domain
+// itself if it doesn't have one.
+func zoneOf(domain string) string {
+	zone, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return zone
+}
+
+// zoneGroups holds back results until every domain of a zone has been
+// processed and then sends them on together.
+//
+// A zone is only known to be complete once the input has moved on to a
+// different zone, so findings are only grouped perfectly when the input is
+// sorted (or otherwise clustered) by zone. A zone that shows up again later
+// in the input starts a new group.
+//
+// With config.outputInterval, whatever has been held back is sent on at
+// least that often even if its zone isn't complete yet, so a zone's results
+// can end up split into several blocks.
+type zoneGroups struct {
+	mu        sync.Mutex
+	zones     map[string]*zoneGroup
+	out       chan<- Result
+	lastFlush time.Time
+}
+
+type zoneGroup struct {
+	pending int
+	closed  bool
+	results []Result
+}
+
+func newZoneGroups(out chan<- Result) *zoneGroups {
+	return &zoneGroups{
+		zones:     make(map[string]*zoneGroup),
+		out:       out,
+		lastFlush: time.Now(),
+	}
+}
+
+// add records that a domain belonging to zone has been dispatched.
+func (g *zoneGroups) add(zone string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	z, ok := g.zones[zone]
+	if !ok {
+		z = &zoneGroup{}
+		g.zones[zone] = z
+	}
+	z.closed = false
+	z.pending++
+}
+
+// close marks that no more domains for zone will be dispatched for now.
+func (g *zoneGroups) close(zone string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	z, ok := g.zones[zone]
+	if !ok {
+		return
+	}
+	z.closed = true
+	g.flush(zone, z)
+}
+
+// done records the results for a single finished domain of zone.
+func (g *zoneGroups) done(zone string, rs []Result) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	z := g.zones[zone]
+	z.pending--
+	z.results = append(z.results, rs...)
+	g.flush(zone, z)
+
+	if config.outputInterval > 0 && time.Since(g.lastFlush) >= config.outputInterval {
+		g.flushPartial()
+	}
+}
+
+// flushPartial sends on everything held back so far, complete zone or not.
+// It must be called with g.mu held.
+func (g *zoneGroups) flushPartial() {
+	for _, z := range g.zones {
+		for _, r := range z.results {
+			sendResult(g.out, r)
+		}
+		z.results = nil
+	}
+	g.lastFlush = time.Now()
+}
+
+// flush must be called with g.mu held.
+func (g *zoneGroups) flush(zone string, z *zoneGroup) {
+	if !z.closed || z.pending > 0 {
+		return
+	}
+	delete(g.zones, zone)
+
+	// every grouped result goes through here with g.mu held, so nothing
+	// else can be interleaved with the zone's block
+	for _, r := range z.results {
+		sendResult(g.out, r)
+	}
+}
+
+// zoneGate limits how many distinct zones have lookups in flight at once.
+type zoneGate struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active map[string]int
+}
+
+func newZoneGate(limit int) *zoneGate {
+	g := &zoneGate{limit: limit, active: make(map[string]int)}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// acquire waits until zone is already active or there's room for another
+// active zone, and counts one more lookup in flight for it.
+func (g *zoneGate) acquire(zone string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for g.active[zone] == 0 && len(g.active) >= g.limit {
+		g.cond.Wait()
+	}
+	g.active[zone]++
+}
+
+func (g *zoneGate) release(zone string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.active[zone]--; g.active[zone] == 0 {
+		delete(g.active, zone)
+		g.cond.Broadcast()
+	}
+}
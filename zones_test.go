@@ -0,0 +1,94 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// zoneStep is one call on zoneGroups: add, close or done, the last with a
+// result for domain. sent is what it should send on.
+type zoneStep struct {
+	op, zone, domain string
+	sent             []string
+}
+
+func TestZoneGroups(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	for _, tt := range []struct {
+		name     string
+		interval time.Duration
+		steps    []zoneStep
+	}{
+		{"held until closed and done", 0, []zoneStep{
+			{"add", "a", "", nil},
+			{"add", "a", "", nil},
+			{"done", "a", "1.a", nil},
+			{"close", "a", "", nil},
+			{"done", "a", "2.a", []string{"1.a", "2.a"}},
+		}},
+		{"done before closed", 0, []zoneStep{
+			{"add", "a", "", nil},
+			{"done", "a", "1.a", nil},
+			{"close", "a", "", []string{"1.a"}},
+		}},
+		{"zones finish out of order", 0, []zoneStep{
+			{"add", "a", "", nil},
+			{"close", "a", "", nil},
+			{"add", "b", "", nil},
+			{"close", "b", "", nil},
+			{"done", "b", "1.b", []string{"1.b"}},
+			{"done", "a", "1.a", []string{"1.a"}},
+		}},
+		{"zone seen again starts a new group", 0, []zoneStep{
+			{"add", "a", "", nil},
+			{"close", "a", "", nil},
+			{"done", "a", "1.a", []string{"1.a"}},
+			{"add", "a", "", nil},
+			{"close", "a", "", nil},
+			{"done", "a", "2.a", []string{"2.a"}},
+		}},
+		{"zone reopened before it finished", 0, []zoneStep{
+			{"add", "a", "", nil},
+			{"close", "a", "", nil},
+			{"add", "a", "", nil},
+			{"done", "a", "1.a", nil},
+			{"close", "a", "", nil},
+			{"done", "a", "2.a", []string{"1.a", "2.a"}},
+		}},
+		{"close of an unknown zone", 0, []zoneStep{
+			{"close", "a", "", nil},
+		}},
+		{"output interval splits a zone", time.Nanosecond, []zoneStep{
+			{"add", "a", "", nil},
+			{"add", "a", "", nil},
+			{"done", "a", "1.a", []string{"1.a"}},
+			{"close", "a", "", nil},
+			{"done", "a", "2.a", []string{"2.a"}},
+		}},
+	} {
+		config.outputInterval = tt.interval
+		out := make(chan Result, 16)
+		g := newZoneGroups(out)
+		for i, s := range tt.steps {
+			switch s.op {
+			case "add":
+				g.add(s.zone)
+			case "close":
+				g.close(s.zone)
+			case "done":
+				g.done(s.zone, []Result{{Domain: s.domain}})
+			}
+
+			var sent []string
+			for len(out) > 0 {
+				sent = append(sent, (<-out).Domain)
+			}
+			if !slices.Equal(sent, s.sent) {
+				t.Errorf("%s: step %d (%s %s) sent %v, want %v", tt.name, i, s.op, s.zone, sent, s.sent)
+			}
+		}
+	}
+}